@@ -0,0 +1,222 @@
+/*
+Copyright 2023 Triggermesh Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+
+	"github.com/triggermesh/aws-custom-runtime/pkg/logger"
+	"github.com/triggermesh/aws-custom-runtime/pkg/tracing"
+)
+
+// invoker is the bootstrap process with its own runtime API endpoint,
+// which lets the runtime track the state of each function instance.
+type invoker struct {
+	index   int
+	address string
+	handler *Handler
+	// logger is tagged with the invoker index and the function name
+	logger *zap.SugaredLogger
+
+	mu           sync.Mutex
+	started      time.Time
+	initialized  bool
+	initDuration time.Duration
+	invocations  int
+	// task is the id of the invocation being executed
+	task      string
+	taskStart time.Time
+	cold      bool
+	span      trace.Span
+}
+
+func newInvoker(index int, address string, handler *Handler) *invoker {
+	return &invoker{
+		index:   index,
+		address: address,
+		handler: handler,
+		logger: handler.logger.With(
+			"invoker", index,
+			"function", os.Getenv("AWS_LAMBDA_FUNCTION_NAME"),
+		),
+		started: time.Now(),
+	}
+}
+
+// run starts the bootstrap process and logs its output
+// with the id of the invocation being executed.
+func (i *invoker) run() error {
+	stdout := logger.NewLineWriter(i.output("stdout"))
+	stderr := logger.NewLineWriter(i.output("stderr"))
+	defer stdout.Flush()
+	defer stderr.Flush()
+
+	cmd := exec.Command("sh", "-c", environment["LAMBDA_TASK_ROOT"]+"/bootstrap")
+	cmd.Env = i.env()
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	return cmd.Run()
+}
+
+// output returns the callback logging the lines of the process output.
+func (i *invoker) output(stream string) func(line string) {
+	return func(line string) {
+		i.mu.Lock()
+		task := i.task
+		i.mu.Unlock()
+		i.logger.Infow(line, "stream", stream, "requestId", task)
+	}
+}
+
+// next passes the queued task to the function.
+func (i *invoker) next(w http.ResponseWriter, r *http.Request) {
+	i.mu.Lock()
+	if !i.initialized {
+		i.initialized = true
+		i.initDuration = time.Since(i.started)
+		i.handler.reporter.ReportInitDuration(i.index, i.initDuration)
+	}
+	if i.span != nil {
+		// the previous invocation has never responded
+		i.span.End()
+		i.span = nil
+		i.task = ""
+		i.handler.reporter.ReportInvokers(i.handler.invokers.update(-1, 0))
+	}
+	i.mu.Unlock()
+
+	i.handler.reporter.ReportInvokers(i.handler.invokers.update(0, 1))
+	task := <-tasks
+	i.handler.reporter.ReportInvokers(i.handler.invokers.update(1, -1))
+	i.handler.reporter.ReportQueueDepth(len(tasks))
+	if !task.queued.IsZero() {
+		i.handler.reporter.ReportQueueWait(time.Since(task.queued))
+	}
+
+	parent := trace.ContextWithSpanContext(context.Background(), task.spanContext)
+	if !task.queued.IsZero() {
+		_, queue := tracing.Tracer().Start(parent, "queue", trace.WithTimestamp(task.queued))
+		queue.End()
+	}
+	ctx, span := tracing.Tracer().Start(parent, "execute", trace.WithAttributes(
+		attribute.Int("invoker", i.index),
+	))
+
+	i.mu.Lock()
+	i.task = task.id
+	i.taskStart = time.Now()
+	i.cold = i.invocations == 0
+	i.invocations++
+	i.span = span
+	i.span.SetAttributes(semconv.FaaSColdstart(i.cold))
+	i.mu.Unlock()
+
+	i.logger.Infow(fmt.Sprintf("START RequestId: %s Version: %s", task.id, os.Getenv("AWS_LAMBDA_FUNCTION_VERSION")),
+		"requestId", task.id)
+
+	writeTask(w, task, tracing.Carrier(ctx))
+}
+
+// response reports the end of the current invocation and passes
+// the function result to the waiting request.
+func (i *invoker) response(w http.ResponseWriter, r *http.Request) {
+	if id, kind, err := parsePath(r.URL.Path); err == nil {
+		i.mu.Lock()
+		if id == i.task {
+			duration := time.Since(i.taskStart)
+			i.report(id, duration)
+			i.handler.reporter.ReportInvocation(duration, i.cold)
+			i.handler.reporter.ReportInvokers(i.handler.invokers.update(-1, 0))
+			if kind == "error" {
+				i.span.SetStatus(codes.Error, "function error")
+			}
+			i.span.End()
+			i.span = nil
+			i.task = ""
+		}
+		i.mu.Unlock()
+	}
+	i.handler.responseHandler(w, r)
+}
+
+// report logs the end of the invocation in the Lambda format.
+func (i *invoker) report(id string, duration time.Duration) {
+	i.logger.Infow("END RequestId: "+id, "requestId", id)
+
+	report := fmt.Sprintf("REPORT RequestId: %s\tDuration: %.2f ms\tBilled Duration: %d ms\tMemory Size: %s MB",
+		id, milliseconds(duration), int64(math.Ceil(milliseconds(duration))), os.Getenv("AWS_LAMBDA_FUNCTION_MEMORY_SIZE"))
+	if i.cold {
+		report += fmt.Sprintf("\tInit Duration: %.2f ms", milliseconds(i.initDuration))
+	}
+	i.logger.Infow(report, "requestId", id)
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// serve starts the runtime API of the invoker.
+func (i *invoker) serve() error {
+	apiRouter := http.NewServeMux()
+	apiRouter.HandleFunc(awsEndpoint+"/init/error", i.handler.initError)
+	apiRouter.HandleFunc(awsEndpoint+"/invocation/next", i.next)
+	apiRouter.HandleFunc(awsEndpoint+"/invocation/", i.response)
+	apiRouter.HandleFunc("/2018-06-01/ping", ping)
+
+	err := http.ListenAndServe(i.address, apiRouter)
+	if err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// env returns the bootstrap process environment.
+func (i *invoker) env() []string {
+	return append(os.Environ(),
+		fmt.Sprintf("BOOTSTRAP_INDEX=%d", i.index),
+		"AWS_LAMBDA_RUNTIME_API="+i.address,
+	)
+}
+
+// invokersState counts the bootstrap processes by their state.
+type invokersState struct {
+	mu   sync.Mutex
+	busy int
+	idle int
+}
+
+// update changes the counters and returns their new values.
+func (s *invokersState) update(busy, idle int) (int, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.busy += busy
+	s.idle += idle
+	return s.busy, s.idle
+}
@@ -17,26 +17,46 @@ limitations under the License.
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
-	"os/exec"
+	"os/signal"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/kelseyhightower/envconfig"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 
+	"github.com/triggermesh/aws-custom-runtime/pkg/batcher"
 	"github.com/triggermesh/aws-custom-runtime/pkg/converter"
+	_ "github.com/triggermesh/aws-custom-runtime/pkg/converter/apigateway"
+	_ "github.com/triggermesh/aws-custom-runtime/pkg/converter/cloudevents"
+	_ "github.com/triggermesh/aws-custom-runtime/pkg/converter/plain"
+	"github.com/triggermesh/aws-custom-runtime/pkg/idempotency"
+	"github.com/triggermesh/aws-custom-runtime/pkg/kafka"
 	"github.com/triggermesh/aws-custom-runtime/pkg/logger"
 	"github.com/triggermesh/aws-custom-runtime/pkg/metrics"
+	"github.com/triggermesh/aws-custom-runtime/pkg/scheduler"
 	"github.com/triggermesh/aws-custom-runtime/pkg/sender"
+	"github.com/triggermesh/aws-custom-runtime/pkg/sqs"
+	"github.com/triggermesh/aws-custom-runtime/pkg/tracing"
 )
 
+// shutdownTimeout limits the graceful shutdown of the external API and
+// the final export of the metrics and spans.
+const shutdownTimeout = 10 * time.Second
+
 var (
 	tasks   chan message
 	results map[string]chan message
@@ -70,27 +90,56 @@ type Specification struct {
 	// Lambda API port to put function requests and get results
 	// Note that this uses the same environment variable Knative uses to communicate expected port.
 	ExternalAPIport string `envconfig:"port" default:"8080"`
-
-	Sink           string `envconfig:"k_sink"`
+	// Prometheus metrics port, must not overlap the runtime API ports
+	MetricsPort string `envconfig:"metrics_prometheus_port" default:"9092"`
+	// Schedule expression to invoke the function periodically,
+	// e.g. "rate(5 minutes)" or "cron(0 12 * * ? *)"
+	Schedule string `envconfig:"schedule"`
+	// Kafka brokers to consume the topics from
+	KafkaBrokers []string `envconfig:"kafka_brokers"`
+	// SQS-compatible queue to poll the messages from
+	SQSQueueURL string `envconfig:"sqs_queue_url"`
+
+	Sink string `envconfig:"k_sink"`
+	// Sink for the events rejected by validation
+	DeadLetterSink string `envconfig:"dead_letter_sink"`
+	// Local address to receive the X-Ray segments sent by the functions
+	XRayDaemonAddress string `envconfig:"xray_daemon_address"`
+	// Idempotency key of the requests: "cloudevent", "header:<name>" or "jsonpath:<expression>"
+	IdempotencyKey string `envconfig:"idempotency_key"`
+	// Maximum number of requests collected into one array invocation, disabled if less than 2
+	MicroBatchSize int    `envconfig:"micro_batch_size"`
 	ResponseFormat string `envconfig:"response_format"`
+	// Format of the incoming requests, defaults to the response format
+	RequestFormat string `envconfig:"request_format"`
+	// Formats selected by the request path prefix, e.g. "/events:CLOUDEVENTS"
+	PathFormats map[string]string `envconfig:"path_formats"`
+	// Formats selected by the request content type, e.g. "application/cloudevents+json:CLOUDEVENTS"
+	ContentTypeFormats map[string]string `envconfig:"content_type_formats"`
 }
 
 type Handler struct {
-	sender    *sender.Sender
-	converter converter.Converter
-	reporter  *metrics.EventProcessingStatsReporter
-	logger    *zap.SugaredLogger
+	sender      *sender.Sender
+	converters  *converter.Router
+	idempotency *idempotency.Guard
+	batcher     *batcher.Batcher
+	reporter    *metrics.EventProcessingStatsReporter
+	logger      *zap.SugaredLogger
 
 	requestSizeLimit int64
 	functionTTL      time.Duration
+	invokers         invokersState
 }
 
 type message struct {
-	id         string
-	deadline   time.Time
-	data       []byte
-	context    map[string]string
-	statusCode int
+	id       string
+	queued   time.Time
+	deadline time.Time
+	// spanContext is the invocation span, parent of the queue and execution spans
+	spanContext trace.SpanContext
+	data        []byte
+	context     map[string]string
+	statusCode  int
 }
 
 func setupEnv(internalAPIport string) error {
@@ -106,6 +155,33 @@ func setupEnv(internalAPIport string) error {
 	return nil
 }
 
+// internalAPIPorts returns the first port of the invokers runtime API range,
+// INTERNAL_API_PORT to INTERNAL_API_PORT+INVOKER_COUNT-1, and checks that
+// the range does not overlap the external API and the metrics ports.
+func internalAPIPorts(spec Specification) (int, error) {
+	first, err := strconv.Atoi(spec.InternalAPIport)
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse internal API port: %w", err)
+	}
+	last := first + spec.NumberOfinvokers - 1
+	if first < 1 || last > 65535 {
+		return 0, fmt.Errorf("internal API ports %d-%d are out of range", first, last)
+	}
+	for name, port := range map[string]string{
+		"external API": spec.ExternalAPIport,
+		"metrics":      spec.MetricsPort,
+	} {
+		p, err := strconv.Atoi(port)
+		if err != nil {
+			return 0, fmt.Errorf("cannot parse %s port: %w", name, err)
+		}
+		if p >= first && p <= last {
+			return 0, fmt.Errorf("%s port %d overlaps internal API ports %d-%d", name, p, first, last)
+		}
+	}
+	return first, nil
+}
+
 func (h *Handler) serve(w http.ResponseWriter, r *http.Request) {
 	eventTypeTag, eventSrcTag := metrics.DefaultRequestType, metrics.DefaultRequestSource
 	start := time.Now()
@@ -113,36 +189,67 @@ func (h *Handler) serve(w http.ResponseWriter, r *http.Request) {
 		h.reporter.ReportProcessingLatency(time.Since(start), eventTypeTag, eventSrcTag)
 	}()
 
+	conv := h.converters.Select(r)
+	ctx := tracing.Extract(context.Background(), r.Header)
+
 	requestSizeLimitInBytes := h.requestSizeLimit * 1e+6
 	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, requestSizeLimitInBytes))
 	if err != nil {
 		h.reporter.ReportProcessingError(false, eventTypeTag, eventSrcTag)
 		h.logger.Error("Request exceeds allowed size limit, rejecting")
-		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		h.replyError(w, conv, nil, converter.NewError(converter.ErrorTypeRequestTooLarge, http.StatusRequestEntityTooLarge,
+			"Request body exceeds %d Mb size limit", h.requestSizeLimit))
 		return
 	}
 	defer r.Body.Close()
 
-	req, context, err := h.converter.Request(body, r.Header)
+	var items []converter.Item
+	batch, isBatch := conv.(converter.BatchConverter)
+	if isBatch {
+		items, isBatch, err = batch.SplitBatch(body, r)
+		if err == nil && isBatch && len(items) == 0 {
+			err = errors.New("events batch is empty")
+		}
+	}
+	if !isBatch {
+		var item converter.Item
+		item.Data, item.Context, err = conv.Request(body, r)
+		items = []converter.Item{item}
+	}
+	var invalid *converter.InvalidEventError
+	if errors.As(err, &invalid) {
+		h.reporter.ReportProcessingError(false, eventTypeTag, eventSrcTag)
+		reply(w, h.rejectEvent(ctx, conv, nil, invalid, http.StatusBadRequest))
+		return
+	}
 	if err != nil {
 		h.reporter.ReportProcessingError(false, eventTypeTag, eventSrcTag)
 		h.logger.Errorf("Cannot convert request: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		h.replyError(w, conv, nil, converter.NewError(converter.ErrorTypeInvalidRequest, http.StatusBadRequest,
+			"Cannot convert request: %v", err))
 		return
 	}
 
-	eventTypeTag, eventSrcTag = metrics.CETagsFromContext(context)
-
-	h.logger.Debugf("Enqueuing request: %+v, %s", context, string(req))
-	result := enqueue(req, context, h.functionTTL)
-	h.logger.Debugf("Result: %+v, %s", result.context, string(result.data))
-
-	result.data, err = h.converter.Response(result.data)
-	if err != nil {
-		result.data = []byte(fmt.Sprintf("Response conversion error: %v", err))
-		h.logger.Errorf("Cannot convert response: %v", err)
+	// the event trace continues if the request has no trace headers
+	if !isBatch && !trace.SpanContextFromContext(ctx).IsValid() {
+		if sc := tracing.EventSpanContext(items[0].Context); sc.IsValid() {
+			ctx = trace.ContextWithRemoteSpanContext(ctx, sc)
+		}
+	}
+	ctx, span := tracing.Tracer().Start(ctx, "serve", trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+
+	keys := h.idempotency.Keys(r.Header, items)
+	var resp *converter.Response
+	if isBatch {
+		resp = h.invokeBatch(ctx, conv, batch, items, keys)
+	} else {
+		eventTypeTag, eventSrcTag = metrics.CETagsFromContext(items[0].Context)
+		resp = h.invoke(ctx, conv, items[0], keys[0])
 	}
-	if err := h.sender.Send(result.data, result.statusCode, w); err != nil {
+
+	if err := h.sender.Send(ctx, resp, w); err != nil {
+		span.SetStatus(codes.Error, err.Error())
 		h.reporter.ReportProcessingError(false, eventTypeTag, eventSrcTag)
 		h.logger.Errorf("Cannot send response: %v", err)
 		return
@@ -150,14 +257,132 @@ func (h *Handler) serve(w http.ResponseWriter, r *http.Request) {
 	h.reporter.ReportProcessingSuccess(eventTypeTag, eventSrcTag)
 }
 
-func enqueue(request []byte, context map[string]string, ttl time.Duration) message {
+// invoke passes the request to the function and converts its result.
+// Requests with the same idempotency key share the function result.
+// Returned response always has the status code set.
+func (h *Handler) invoke(ctx context.Context, conv converter.ResponseConverter, item converter.Item, key string) *converter.Response {
+	result := h.idempotency.Do(key, func() idempotency.Result {
+		h.logger.Debugf("Enqueuing request: %+v, %s", item.Context, string(item.Data))
+		data, statusCode := h.execute(ctx, item)
+		h.logger.Debugf("Result: %d, %s", statusCode, string(data))
+		return idempotency.Result{Data: data, StatusCode: statusCode}
+	})
+
+	var resp *converter.Response
+	var err error
+	var invalid *converter.InvalidEventError
+	if result.StatusCode >= http.StatusBadRequest {
+		resp = h.renderError(conv, item.Context, converter.ParseError(result.Data, result.StatusCode))
+	} else if resp, err = conv.Response(result.Data, item.Context); errors.As(err, &invalid) {
+		resp = h.rejectEvent(ctx, conv, item.Context, invalid, http.StatusBadGateway)
+	} else if err != nil {
+		h.logger.Errorf("Cannot convert response: %v", err)
+		resp = h.renderError(conv, item.Context, converter.NewError(converter.ErrorTypeInvalidResponse, http.StatusBadGateway,
+			"Cannot convert response: %v", err))
+	}
+	if resp.StatusCode == 0 {
+		resp.StatusCode = result.StatusCode
+	}
+	return resp
+}
+
+// execute runs the function with the item. When micro-batching is enabled
+// the item is invoked as the element of the events array, unless it carries
+// the runtime context, e.g. CloudEvent attributes, which the batch cannot pass.
+func (h *Handler) execute(ctx context.Context, item converter.Item) ([]byte, int) {
+	if h.batcher != nil && len(item.Context) == 0 {
+		return h.batcher.Invoke(ctx, item.Data)
+	}
+	result := h.enqueue(ctx, item.Data, item.Context)
+	return result.data, result.statusCode
+}
+
+// invokeBatch runs batch items concurrently and aggregates their responses.
+func (h *Handler) invokeBatch(ctx context.Context, conv converter.ResponseConverter, batch converter.BatchConverter, items []converter.Item, keys []string) *converter.Response {
+	responses := make([]*converter.Response, len(items))
+	var wg sync.WaitGroup
+	for i, item := range items {
+		wg.Add(1)
+		go func(i int, item converter.Item) {
+			defer wg.Done()
+			// batched events are linked to their own traces
+			var opts []trace.SpanStartOption
+			if sc := tracing.EventSpanContext(item.Context); sc.IsValid() {
+				opts = append(opts, trace.WithLinks(trace.Link{SpanContext: sc}))
+			}
+			ctx, span := tracing.Tracer().Start(ctx, "event", opts...)
+			defer span.End()
+			responses[i] = h.invoke(ctx, conv, item, keys[i])
+		}(i, item)
+	}
+	wg.Wait()
+
+	resp, err := batch.JoinBatch(responses)
+	if err != nil {
+		h.logger.Errorf("Cannot aggregate batch responses: %v", err)
+		return h.renderError(conv, nil, converter.NewError(converter.ErrorTypeInvalidResponse, http.StatusBadGateway,
+			"Cannot aggregate batch responses: %v", err))
+	}
+	return resp
+}
+
+// renderError converts the error into the response format,
+// falling back to the Lambda error JSON.
+func (h *Handler) renderError(conv converter.ResponseConverter, context map[string]string, e *converter.Error) *converter.Response {
+	resp, err := conv.Error(e, context)
+	if err != nil {
+		h.logger.Errorf("Cannot convert error response: %v", err)
+		resp = converter.NewResponse(e.JSON(), "application/json")
+		resp.StatusCode = e.StatusCode
+	}
+	return resp
+}
+
+// rejectEvent forwards the invalid event to the dead-letter sink and
+// acknowledges it or, if there is no sink, renders the validation error.
+func (h *Handler) rejectEvent(ctx context.Context, conv converter.ResponseConverter, context map[string]string, invalid *converter.InvalidEventError, statusCode int) *converter.Response {
+	h.logger.Errorf("Rejecting event: %v", invalid.Err)
+	err := h.sender.DeadLetter(ctx, invalid.Event)
+	if err == nil {
+		return &converter.Response{StatusCode: http.StatusAccepted}
+	}
+	if !errors.Is(err, sender.ErrNoDeadLetterSink) {
+		h.logger.Errorf("Cannot deliver rejected event: %v", err)
+	}
+	return h.renderError(conv, context, converter.NewError(converter.ErrorTypeInvalidEvent, statusCode,
+		"Invalid event: %v", invalid.Err))
+}
+
+// replyError writes runtime error directly to the caller.
+func (h *Handler) replyError(w http.ResponseWriter, conv converter.ResponseConverter, context map[string]string, e *converter.Error) {
+	reply(w, h.renderError(conv, context, e))
+}
+
+// reply writes the response directly to the caller.
+func reply(w http.ResponseWriter, resp *converter.Response) {
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+	w.Write(resp.Body)
+}
+
+// enqueue passes the request to the first free invoker and waits for the result.
+func (h *Handler) enqueue(ctx context.Context, request []byte, context map[string]string) message {
 	task := message{
 		id:       uuid.New().String(),
-		deadline: time.Now().Add(ttl),
+		queued:   time.Now(),
+		deadline: time.Now().Add(h.functionTTL),
 		data:     request,
 		context:  context,
 	}
 
+	_, span := tracing.Tracer().Start(ctx, "invoke", trace.WithAttributes(
+		semconv.FaaSInvocationID(task.id),
+	))
+	defer span.End()
+	task.spanContext = span.SpanContext()
+
 	resultsChannel := make(chan message)
 	mutex.Lock()
 	results[task.id] = resultsChannel
@@ -165,13 +390,15 @@ func enqueue(request []byte, context map[string]string, ttl time.Duration) messa
 	defer close(resultsChannel)
 
 	tasks <- task
+	h.reporter.ReportQueueDepth(len(tasks))
 
 	var resp message
 	select {
-	case <-time.After(ttl):
+	case <-time.After(h.functionTTL):
+		h.reporter.ReportTimeout()
 		resp = message{
 			id:         task.id,
-			data:       []byte(fmt.Sprintf("Deadline is reached, data %s", task.data)),
+			data:       converter.NewError(converter.ErrorTypeTimeout, http.StatusGone, "Task timed out after %s", h.functionTTL).JSON(),
 			statusCode: http.StatusGone,
 		}
 	case result := <-resultsChannel:
@@ -180,17 +407,28 @@ func enqueue(request []byte, context map[string]string, ttl time.Duration) messa
 	mutex.Lock()
 	delete(results, task.id)
 	mutex.Unlock()
+
+	span.SetAttributes(attribute.Int("faas.status_code", resp.statusCode))
+	if resp.statusCode >= http.StatusBadRequest {
+		span.SetStatus(codes.Error, converter.ParseError(resp.data, resp.statusCode).Error())
+	}
 	return resp
 }
 
-func getTask(w http.ResponseWriter, r *http.Request) {
-	task := <-tasks
-
+// writeTask passes the task to the function with the Lambda invocation headers.
+// Trace headers carry the span of the execution.
+func writeTask(w http.ResponseWriter, task message, traceHeaders map[string]string) {
 	// Dummy headers required by Rust client. Replace with something meaningful
 	w.Header().Set("Lambda-Runtime-Aws-Request-Id", task.id)
 	w.Header().Set("Lambda-Runtime-Deadline-Ms", strconv.Itoa(int(task.deadline.UnixMilli())))
 	w.Header().Set("Lambda-Runtime-Invoked-Function-Arn", "arn:aws:lambda:us-east-1:123456789012:function:custom-runtime")
 	w.Header().Set("Lambda-Runtime-Trace-Id", "0")
+	if xray, set := traceHeaders[tracing.XRayHeader]; set {
+		w.Header().Set("Lambda-Runtime-Trace-Id", xray)
+	}
+	for k, v := range traceHeaders {
+		w.Header().Set(k, v)
+	}
 	for k, v := range task.context {
 		w.Header().Set(k, v)
 	}
@@ -269,25 +507,6 @@ func ping(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("pong"))
 }
 
-func (h *Handler) internalAPI() error {
-	internalSocket, _ := os.LookupEnv("AWS_LAMBDA_RUNTIME_API")
-	if internalSocket == "" {
-		return fmt.Errorf("AWS_LAMBDA_RUNTIME_API is not set")
-	}
-
-	apiRouter := http.NewServeMux()
-	apiRouter.HandleFunc(awsEndpoint+"/init/error", h.initError)
-	apiRouter.HandleFunc(awsEndpoint+"/invocation/next", getTask)
-	apiRouter.HandleFunc(awsEndpoint+"/invocation/", h.responseHandler)
-	apiRouter.HandleFunc("/2018-06-01/ping", ping)
-
-	err := http.ListenAndServe(internalSocket, apiRouter)
-	if err != nil && err != http.ErrServerClosed {
-		return err
-	}
-	return nil
-}
-
 func main() {
 	logger := logger.New()
 
@@ -297,13 +516,21 @@ func main() {
 		logger.Fatalf("Cannot process env variables: %v", err)
 	}
 	logger.Debugf("Runtime specification: %+v", spec)
+
+	// stop on the termination signals
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
 	logger.Debug("Setting up runtime env")
+	if spec.XRayDaemonAddress != "" {
+		environment["AWS_XRAY_DAEMON_ADDRESS"] = spec.XRayDaemonAddress
+	}
 	if err := setupEnv(spec.InternalAPIport); err != nil {
 		logger.Fatalf("Cannot setup runime env: %v", err)
 	}
 
-	// create converter
-	conv, err := converter.New(spec.ResponseFormat)
+	// create converters
+	converters, err := converter.NewRouter(spec.RequestFormat, spec.ResponseFormat, spec.PathFormats, spec.ContentTypeFormats)
 	if err != nil {
 		logger.Fatalf("Cannot create converter: %v", err)
 	}
@@ -314,10 +541,36 @@ func main() {
 		logger.Fatalf("Cannot start stats exporter: %v", err)
 	}
 
+	// setup tracing
+	if err := tracing.Setup(); err != nil {
+		logger.Fatalf("Cannot setup tracing: %v", err)
+	}
+	if spec.XRayDaemonAddress != "" {
+		listener, err := tracing.NewXRayListener(spec.XRayDaemonAddress, logger)
+		if err != nil {
+			logger.Fatalf("Cannot start X-Ray segments listener: %v", err)
+		}
+		go listener.Run(ctx)
+	}
+
 	// setup sender
+	sndr, err := sender.New(spec.Sink, spec.DeadLetterSink, mr, logger)
+	if err != nil {
+		logger.Fatalf("Cannot create sender: %v", err)
+	}
+
+	// setup idempotency guard
+	var guard *idempotency.Guard
+	if spec.IdempotencyKey != "" {
+		if guard, err = idempotency.New(spec.IdempotencyKey, logger); err != nil {
+			logger.Fatalf("Cannot create idempotency guard: %v", err)
+		}
+	}
+
 	handler := Handler{
-		sender:           sender.New(spec.Sink, conv.ContentType()),
-		converter:        conv,
+		sender:           sndr,
+		converters:       converters,
+		idempotency:      guard,
 		reporter:         mr,
 		logger:           logger,
 		requestSizeLimit: spec.RequestSizeLimit,
@@ -329,34 +582,103 @@ func main() {
 	results = make(map[string]chan message)
 	defer close(tasks)
 
-	// start Lambda API
-	logger.Debug("Starting API")
-	go func() {
-		if err := handler.internalAPI(); err != nil {
-			logger.Fatalf("Runtime internal API error: %v", err)
-		}
-	}()
-
-	// start invokers
+	// start invokers, each with its own Lambda API port
+	apiPort, err := internalAPIPorts(spec)
+	if err != nil {
+		logger.Fatalf("Invalid internal API ports: %v", err)
+	}
 	for i := 0; i < spec.NumberOfinvokers; i++ {
+		inv := newInvoker(i, fmt.Sprintf("127.0.0.1:%d", apiPort+i), &handler)
+		logger.Debugf("Starting API %s", inv.address)
+		go func() {
+			if err := inv.serve(); err != nil {
+				logger.Fatalf("Runtime internal API error: %v", err)
+			}
+		}()
+
 		logger.Debug("Starting bootstrap", i+1)
-		go func(i int) {
-			cmd := exec.Command("sh", "-c", environment["LAMBDA_TASK_ROOT"]+"/bootstrap")
-			cmd.Env = append(os.Environ(), fmt.Sprintf("BOOTSTRAP_INDEX=%d", i))
-			cmd.Stdout = os.Stdout
-			cmd.Stderr = os.Stderr
-			if err := cmd.Run(); err != nil {
+		go func() {
+			if err := inv.run(); err != nil {
 				logger.Fatalf("Cannot start bootstrap process: %v", err)
 			}
-		}(i)
+		}()
+	}
+
+	// invoke passes the batches and the events of the internal sources to the function
+	invoke := func(ctx context.Context, event []byte) ([]byte, int) {
+		result := handler.enqueue(ctx, event, nil)
+		return result.data, result.statusCode
+	}
+
+	// start micro-batching
+	if spec.MicroBatchSize > 1 {
+		b, err := batcher.New(spec.MicroBatchSize, invoke, logger)
+		if err != nil {
+			logger.Fatalf("Cannot create micro-batcher: %v", err)
+		}
+		handler.batcher = b
+		go b.Run(ctx)
+	}
+
+	// start scheduler
+	if spec.Schedule != "" {
+		sched, err := scheduler.New(spec.Schedule, invoke, logger)
+		if err != nil {
+			logger.Fatalf("Cannot create scheduler: %v", err)
+		}
+		go sched.Run(ctx)
+	}
+
+	// start Kafka consumer
+	if len(spec.KafkaBrokers) != 0 {
+		consumer, err := kafka.New(spec.KafkaBrokers, invoke, logger)
+		if err != nil {
+			logger.Fatalf("Cannot create Kafka consumer: %v", err)
+		}
+		go consumer.Run(ctx)
+	}
+
+	// start SQS poller
+	if spec.SQSQueueURL != "" {
+		poller, err := sqs.New(spec.SQSQueueURL, invoke, logger)
+		if err != nil {
+			logger.Fatalf("Cannot create SQS poller: %v", err)
+		}
+		go poller.Run(ctx)
 	}
 
 	// start external API
 	taskRouter := http.NewServeMux()
 	taskRouter.Handle("/", http.HandlerFunc(handler.serve))
+	server := &http.Server{
+		Addr:    ":" + spec.ExternalAPIport,
+		Handler: taskRouter,
+	}
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-ctx.Done()
+		logger.Info("Shutting down runtime")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			logger.Errorf("Cannot shut down external API: %v", err)
+		}
+	}()
 	logger.Info("Runtime initialized")
-	err = http.ListenAndServe(":"+spec.ExternalAPIport, taskRouter)
+	err = server.ListenAndServe()
 	if err != nil && err != http.ErrServerClosed {
 		logger.Fatalf("Runtime external API error: %v", err)
 	}
+	<-stopped
+
+	// export the buffered spans and the last metrics
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := tracing.Shutdown(shutdownCtx); err != nil {
+		logger.Errorf("Cannot flush traces: %v", err)
+	}
+	if err := mr.Shutdown(shutdownCtx); err != nil {
+		logger.Errorf("Cannot flush metrics: %v", err)
+	}
 }
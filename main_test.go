@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -9,15 +10,24 @@ import (
 	"net/http/httptest"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/kelseyhightower/envconfig"
+	"github.com/triggermesh/aws-custom-runtime/pkg/batcher"
 	"github.com/triggermesh/aws-custom-runtime/pkg/converter"
+	"github.com/triggermesh/aws-custom-runtime/pkg/converter/cloudevents"
+	_ "github.com/triggermesh/aws-custom-runtime/pkg/converter/plain"
 	"github.com/triggermesh/aws-custom-runtime/pkg/logger"
 	"github.com/triggermesh/aws-custom-runtime/pkg/metrics"
 	"github.com/triggermesh/aws-custom-runtime/pkg/sender"
+	"github.com/triggermesh/aws-custom-runtime/pkg/tracing"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
 )
 
 func TestSetupEnv(t *testing.T) {
@@ -27,17 +37,60 @@ func TestSetupEnv(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	t.Setenv("LAMBDA_TASK_ROOT", "/var/task")
+	t.Setenv("LAMBDA_RUNTIME_DIR", "/var/runtime")
+	t.Setenv("LD_LIBRARY_PATH", "/usr/local/lib")
+
 	if err := setupEnv(s.InternalAPIport); err != nil {
 		t.Errorf("Setup Env error %s\n", err)
 	}
 
+	expected := map[string]string{
+		"LD_LIBRARY_PATH":        "/lib64:/usr/lib64:/var/runtime:/var/runtime/lib:/var/task:/var/task/lib:/opt/lib:/usr/local/lib",
+		"AWS_LAMBDA_RUNTIME_API": "127.0.0.1:" + s.InternalAPIport,
+		"LAMBDA_TASK_ROOT":       "/var/task",
+	}
 	for k, v := range environment {
+		if _, ok := expected[k]; !ok {
+			expected[k] = v
+		}
+	}
+	for k, v := range expected {
 		if value, _ := os.LookupEnv(k); value != v {
 			t.Errorf("Env variable mismath: got %s, expected %s\n", value, v)
 		}
 	}
 }
 
+func TestInternalAPIPorts(t *testing.T) {
+	tests := []struct {
+		name     string
+		internal string
+		invokers int
+		wantErr  bool
+	}{
+		{name: "Default", internal: "80", invokers: 4},
+		{name: "Overlaps external API", internal: "8077", invokers: 4, wantErr: true},
+		{name: "Overlaps metrics", internal: "9090", invokers: 4, wantErr: true},
+		{name: "Next to external API", internal: "8076", invokers: 4},
+		{name: "Out of range", internal: "65534", invokers: 4, wantErr: true},
+		{name: "Invalid", internal: "foo", invokers: 4, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := Specification{
+				InternalAPIport:  tt.internal,
+				NumberOfinvokers: tt.invokers,
+				ExternalAPIport:  "8080",
+				MetricsPort:      "9092",
+			}
+			if _, err := internalAPIPorts(spec); (err != nil) != tt.wantErr {
+				t.Errorf("internalAPIPorts() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
 func TestNewTask(t *testing.T) {
 	var s Specification
 	err := envconfig.Process("", &s)
@@ -45,7 +98,7 @@ func TestNewTask(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	conv, err := converter.New(s.ResponseFormat)
+	converters, err := converter.NewRouter(s.RequestFormat, s.ResponseFormat, s.PathFormats, s.ContentTypeFormats)
 	if err != nil {
 		log.Fatalf("Cannot create converter: %v", err)
 	}
@@ -56,9 +109,14 @@ func TestNewTask(t *testing.T) {
 		log.Fatalf("Cannot start stats exporter: %v", err)
 	}
 
+	sndr, err := sender.New(s.Sink, s.DeadLetterSink, mr, logger.New())
+	if err != nil {
+		log.Fatalf("Cannot create sender: %v", err)
+	}
+
 	handler := Handler{
-		sender:           sender.New(s.Sink, conv.ContentType()),
-		converter:        conv,
+		sender:           sndr,
+		converters:       converters,
 		reporter:         mr,
 		logger:           logger.New(),
 		requestSizeLimit: s.RequestSizeLimit,
@@ -79,20 +137,47 @@ func TestNewTask(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	go h.ServeHTTP(recorder, req)
+	done := make(chan struct{})
+	go func() {
+		h.ServeHTTP(recorder, req)
+		close(done)
+	}()
 	task := <-tasks
+	// echo the task back the way the function response handler does
+	task.statusCode = http.StatusOK
 	results[task.id] <- task
-	time.Sleep(time.Millisecond * 100)
+	<-done
 
-	// TODO: fix status codes
-	// if status := recorder.Code; status != http.StatusOK {
-	// t.Errorf("Got %d status code, expecting %d", recorder.Code, http.StatusOK)
-	// }
+	if status := recorder.Code; status != http.StatusOK {
+		t.Errorf("Got %d status code, expecting %d", recorder.Code, http.StatusOK)
+	}
 	if recorder.Body.String() != string(payload) {
 		t.Errorf("Got %q body, expecting %q", recorder.Body.String(), payload)
 	}
 }
 
+func TestServeEmptyBatch(t *testing.T) {
+	converters, err := converter.NewRouter("CLOUDEVENTS", "CLOUDEVENTS", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := Handler{
+		converters:       converters,
+		logger:           zap.NewNop().Sugar(),
+		requestSizeLimit: 5,
+		functionTTL:      time.Second,
+	}
+
+	req := httptest.NewRequest("POST", "/", bytes.NewBufferString(`[]`))
+	req.Header.Set("Content-Type", cloudevents.BatchContentType)
+	recorder := httptest.NewRecorder()
+	handler.serve(recorder, req)
+
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Got %d status code of the empty batch, expecting %d", recorder.Code, http.StatusBadRequest)
+	}
+}
+
 func TestGetTask(t *testing.T) {
 	payload := message{id: "123", deadline: time.Now(), data: []byte(`{"payload": "test"}`)}
 
@@ -100,8 +185,9 @@ func TestGetTask(t *testing.T) {
 	results = make(map[string]chan message)
 	defer close(tasks)
 
+	inv := newInvoker(0, "", &Handler{logger: logger.New()})
 	recorder := httptest.NewRecorder()
-	handler := http.HandlerFunc(getTask)
+	handler := http.HandlerFunc(inv.next)
 
 	req, err := http.NewRequest("GET", "/", nil)
 	if err != nil {
@@ -119,8 +205,8 @@ func TestGetTask(t *testing.T) {
 		t.Errorf("Got %q id, expecting %q", id, payload.id)
 	}
 	deadline := recorder.Header().Get("Lambda-Runtime-Deadline-Ms")
-	if deadline != payload.deadline.String() {
-		t.Errorf("Got %q deadline, expecting %q", deadline, payload.deadline)
+	if expected := strconv.FormatInt(payload.deadline.UnixMilli(), 10); deadline != expected {
+		t.Errorf("Got %q deadline, expecting %q", deadline, expected)
 	}
 	if recorder.Body.String() != string(payload.data) {
 		t.Errorf("Got %q body, expecting %q", recorder.Body.String(), payload.data)
@@ -153,9 +239,9 @@ func TestInitError(t *testing.T) {
 		t.Fatal(err)
 	}
 	gotBytes, _ := ioutil.ReadAll(stdout)
-	expected := fmt.Sprintf("Runtime initialization error: %s\n", string(payload))
+	expected := fmt.Sprintf(`"message":"Runtime initialization error: %s"`, string(payload))
 	got := string(gotBytes)
-	if !strings.HasSuffix(got, expected) {
+	if !strings.Contains(got, expected) {
 		t.Errorf("Got %q exit message, expecting %q", got, expected)
 	}
 }
@@ -219,3 +305,152 @@ func TestResponseHandler(t *testing.T) {
 		}
 	}
 }
+
+func TestInvoker(t *testing.T) {
+	tasks = make(chan message, 100)
+	results = make(map[string]chan message)
+	defer close(tasks)
+
+	h := &Handler{logger: logger.New()}
+	inv := newInvoker(0, "", h)
+	results["foo"] = make(chan message, 1)
+	tasks <- message{id: "foo", queued: time.Now()}
+
+	inv.next(httptest.NewRecorder(), httptest.NewRequest("GET", awsEndpoint+"/invocation/next", nil))
+	if busy, idle := h.invokers.update(0, 0); busy != 1 || idle != 0 {
+		t.Errorf("Got %d busy and %d idle invokers after next, expecting 1 and 0", busy, idle)
+	}
+	if !inv.initialized || !inv.cold || inv.task != "foo" {
+		t.Errorf("Got invoker state %+v, expecting initialized cold invoker executing %q", inv, "foo")
+	}
+
+	inv.response(httptest.NewRecorder(), httptest.NewRequest("POST", awsEndpoint+"/invocation/foo/response", bytes.NewBufferString("{}")))
+	if busy, _ := h.invokers.update(0, 0); busy != 0 {
+		t.Errorf("Got %d busy invokers after response, expecting 0", busy)
+	}
+	if result := <-results["foo"]; string(result.data) != "{}" {
+		t.Errorf("Got %q result, expecting %q", result.data, "{}")
+	}
+}
+
+func TestInvokerStaleTask(t *testing.T) {
+	tasks = make(chan message, 100)
+	results = make(map[string]chan message)
+	defer close(tasks)
+
+	h := &Handler{logger: logger.New()}
+	inv := newInvoker(0, "", h)
+	tasks <- message{id: "foo"}
+	tasks <- message{id: "bar"}
+
+	inv.next(httptest.NewRecorder(), httptest.NewRequest("GET", awsEndpoint+"/invocation/next", nil))
+	inv.next(httptest.NewRecorder(), httptest.NewRequest("GET", awsEndpoint+"/invocation/next", nil))
+	if busy, idle := h.invokers.update(0, 0); busy != 1 || idle != 0 {
+		t.Errorf("Got %d busy and %d idle invokers after dropped task, expecting 1 and 0", busy, idle)
+	}
+	if inv.task != "bar" {
+		t.Errorf("Got invoker executing %q, expecting %q", inv.task, "bar")
+	}
+}
+
+func TestInvokerTrace(t *testing.T) {
+	if err := tracing.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	tasks = make(chan message, 100)
+	results = make(map[string]chan message)
+	defer close(tasks)
+
+	header := http.Header{}
+	header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	sc := trace.SpanContextFromContext(tracing.Extract(context.Background(), header))
+	tasks <- message{id: "foo", queued: time.Now(), spanContext: sc}
+
+	inv := newInvoker(0, "", &Handler{logger: logger.New()})
+	recorder := httptest.NewRecorder()
+	inv.next(recorder, httptest.NewRequest("GET", awsEndpoint+"/invocation/next", nil))
+
+	traceID := recorder.Header().Get("Lambda-Runtime-Trace-Id")
+	if !strings.HasPrefix(traceID, "Root=1-4bf92f35-77b34da6a3ce929d0e0e4736;Parent=") {
+		t.Errorf("Got %q trace id, expecting X-Ray header of the inbound trace", traceID)
+	}
+	if traceparent := recorder.Header().Get("traceparent"); !strings.Contains(traceparent, "4bf92f3577b34da6a3ce929d0e0e4736") {
+		t.Errorf("Got %q traceparent, expecting the inbound trace", traceparent)
+	}
+}
+
+func TestExecuteMicroBatch(t *testing.T) {
+	tasks = make(chan message, 100)
+	results = make(map[string]chan message)
+	defer close(tasks)
+
+	// the batcher is never run, batched items wait until the context is done
+	b, err := batcher.New(2, func(ctx context.Context, event []byte) ([]byte, int) {
+		return []byte(`["ok","ok"]`), http.StatusOK
+	}, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &Handler{batcher: b, functionTTL: time.Second, logger: zap.NewNop().Sugar()}
+
+	go func() {
+		for task := range tasks {
+			mutex.RLock()
+			results[task.id] <- message{id: task.id, data: []byte(task.context["Ce-Id"]), statusCode: http.StatusOK}
+			mutex.RUnlock()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, statusCode := h.execute(ctx, converter.Item{Data: []byte(`{}`)}); statusCode != http.StatusGatewayTimeout {
+		t.Errorf("Got %d status code of the batched item, want %d", statusCode, http.StatusGatewayTimeout)
+	}
+
+	// items with the runtime context skip the batcher
+	data, statusCode := h.execute(context.Background(), converter.Item{Data: []byte(`{}`), Context: map[string]string{"Ce-Id": "1"}})
+	if statusCode != http.StatusOK || string(data) != "1" {
+		t.Errorf("Got %d status code and %q response, want the function invoked with the item context", statusCode, data)
+	}
+}
+
+func TestInvokerLogs(t *testing.T) {
+	tasks = make(chan message, 100)
+	results = make(map[string]chan message)
+	defer close(tasks)
+
+	core, logs := observer.New(zapcore.InfoLevel)
+	inv := newInvoker(1, "", &Handler{logger: zap.New(core).Sugar()})
+	output := inv.output("stdout")
+
+	output("initializing")
+	results["foo"] = make(chan message, 1)
+	tasks <- message{id: "foo"}
+	inv.next(httptest.NewRecorder(), httptest.NewRequest("GET", awsEndpoint+"/invocation/next", nil))
+	output("processing")
+	inv.response(httptest.NewRecorder(), httptest.NewRequest("POST", awsEndpoint+"/invocation/foo/response", bytes.NewBufferString("{}")))
+
+	expected := []struct {
+		prefix    string
+		requestID string
+	}{
+		{"initializing", ""},
+		{"START RequestId: foo Version: ", "foo"},
+		{"processing", "foo"},
+		{"END RequestId: foo", "foo"},
+		{"REPORT RequestId: foo\tDuration: ", "foo"},
+	}
+	entries := logs.All()
+	if len(entries) != len(expected) {
+		t.Fatalf("Got %d log entries, expecting %d", len(entries), len(expected))
+	}
+	for i, e := range expected {
+		fields := entries[i].ContextMap()
+		if !strings.HasPrefix(entries[i].Message, e.prefix) || fields["requestId"] != e.requestID || fields["invoker"] != int64(1) {
+			t.Errorf("Got %q entry with %v fields, expecting %q of request %q", entries[i].Message, fields, e.prefix, e.requestID)
+		}
+	}
+	if report := entries[4].Message; !strings.Contains(report, "Init Duration: ") {
+		t.Errorf("Got %q report of the cold invocation, expecting init duration", report)
+	}
+}
@@ -0,0 +1,201 @@
+/*
+Copyright 2023 Triggermesh Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package batcher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+
+	"github.com/triggermesh/aws-custom-runtime/pkg/converter"
+	"github.com/triggermesh/aws-custom-runtime/pkg/lambda"
+	"github.com/triggermesh/aws-custom-runtime/pkg/tracing"
+)
+
+// Batcher collects the concurrent events into JSON arrays and invokes
+// the function once per array. Function must respond with the array of
+// the same length, its elements are returned to the callers by index.
+type Batcher struct {
+	// Window is the maximum time the first event of the batch waits for the others.
+	Window time.Duration `envconfig:"window" default:"10ms"`
+
+	size     int
+	invoke   lambda.Invoke
+	requests chan *request
+	// done is closed when Run returns
+	done   chan struct{}
+	logger *zap.SugaredLogger
+}
+
+type request struct {
+	ctx    context.Context
+	event  json.RawMessage
+	result chan result
+}
+
+type result struct {
+	data       []byte
+	statusCode int
+}
+
+// New returns the Batcher that invokes the function with up to size events.
+func New(size int, invoke lambda.Invoke, logger *zap.SugaredLogger) (*Batcher, error) {
+	b := Batcher{
+		size:     size,
+		invoke:   invoke,
+		requests: make(chan *request),
+		done:     make(chan struct{}),
+		logger:   logger,
+	}
+	if err := envconfig.Process("micro_batch", &b); err != nil {
+		return nil, fmt.Errorf("cannot process micro-batching env variables: %w", err)
+	}
+	if size < 2 {
+		return nil, fmt.Errorf("batch size must be greater than 1, got %d", size)
+	}
+	if b.Window <= 0 {
+		return nil, fmt.Errorf("batch window must be positive, got %s", b.Window)
+	}
+	return &b, nil
+}
+
+// Invoke adds the event to the next batch and waits for its result.
+// Events that are not valid JSON are passed to the function as is.
+// Invocation fails if the context is done or the batcher is stopped
+// before the result is ready.
+func (b *Batcher) Invoke(ctx context.Context, event []byte) ([]byte, int) {
+	if !json.Valid(event) {
+		return b.invoke(ctx, event)
+	}
+	r := &request{
+		ctx:    ctx,
+		event:  event,
+		result: make(chan result, 1),
+	}
+	select {
+	case b.requests <- r:
+	case <-ctx.Done():
+		return canceled(ctx)
+	case <-b.done:
+		e := converter.NewError(converter.ErrorTypeUnavailable, http.StatusServiceUnavailable, "Micro-batcher is stopped")
+		return e.JSON(), e.StatusCode
+	}
+	// result channel is buffered, the batch does not block if the caller is gone
+	select {
+	case res := <-r.result:
+		return res.data, res.statusCode
+	case <-ctx.Done():
+		return canceled(ctx)
+	}
+}
+
+func canceled(ctx context.Context) ([]byte, int) {
+	e := converter.NewError(converter.ErrorTypeTimeout, http.StatusGatewayTimeout, "Batched invocation is canceled: %v", ctx.Err())
+	return e.JSON(), e.StatusCode
+}
+
+// Run blocks and collects the batches until the context is done.
+// Batch is invoked when it is full or when the window has passed.
+func (b *Batcher) Run(ctx context.Context) {
+	defer close(b.done)
+	for {
+		var batch []*request
+		select {
+		case <-ctx.Done():
+			return
+		case r := <-b.requests:
+			batch = append(batch, r)
+		}
+
+		timer := time.NewTimer(b.Window)
+	collect:
+		for len(batch) < b.size {
+			select {
+			case r := <-b.requests:
+				batch = append(batch, r)
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+		go b.flush(batch)
+	}
+}
+
+func (b *Batcher) flush(batch []*request) {
+	events := make([]json.RawMessage, len(batch))
+	for i, r := range batch {
+		events[i] = r.event
+	}
+	data, err := json.Marshal(events)
+	if err != nil {
+		b.fail(batch, converter.NewError(converter.ErrorTypeInvalidRequest, http.StatusBadRequest,
+			"Cannot encode events batch: %v", err))
+		return
+	}
+
+	// batch continues the trace of its first request and links the others
+	links := make([]trace.Link, 0, len(batch)-1)
+	for _, r := range batch[1:] {
+		if sc := trace.SpanContextFromContext(r.ctx); sc.IsValid() {
+			links = append(links, trace.Link{SpanContext: sc})
+		}
+	}
+	ctx, span := tracing.Tracer().Start(batch[0].ctx, "batch",
+		trace.WithLinks(links...),
+		trace.WithAttributes(attribute.Int("batch.size", len(batch))),
+	)
+	defer span.End()
+
+	b.logger.Debugf("Invoking batch of %d events", len(batch))
+	response, statusCode := b.invoke(ctx, data)
+	if statusCode >= http.StatusBadRequest {
+		for _, r := range batch {
+			r.result <- result{data: response, statusCode: statusCode}
+		}
+		return
+	}
+
+	var responses []json.RawMessage
+	if err := json.Unmarshal(response, &responses); err != nil {
+		b.fail(batch, converter.NewError(converter.ErrorTypeInvalidResponse, http.StatusBadGateway,
+			"Batch response is not a JSON array: %v", err))
+		return
+	}
+	if len(responses) != len(batch) {
+		b.fail(batch, converter.NewError(converter.ErrorTypeInvalidResponse, http.StatusBadGateway,
+			"Batch response has %d elements, expected %d", len(responses), len(batch)))
+		return
+	}
+	for i, r := range batch {
+		r.result <- result{data: responses[i], statusCode: statusCode}
+	}
+}
+
+func (b *Batcher) fail(batch []*request, e *converter.Error) {
+	b.logger.Errorf("Batch invocation failed: %v", e)
+	for _, r := range batch {
+		r.result <- result{data: e.JSON(), statusCode: e.StatusCode}
+	}
+}
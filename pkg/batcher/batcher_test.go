@@ -0,0 +1,198 @@
+package batcher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+func TestInvoke(t *testing.T) {
+	tests := []struct {
+		name               string
+		function           func(events []json.RawMessage) ([]byte, int)
+		expectedStatusCode int
+		expectedResponse   func(i int) string
+	}{
+		{
+			name: "Responses by index",
+			function: func(events []json.RawMessage) ([]byte, int) {
+				responses := make([]string, len(events))
+				for i, e := range events {
+					responses[i] = "re:" + string(e)
+				}
+				data, _ := json.Marshal(responses)
+				return data, http.StatusOK
+			},
+			expectedStatusCode: http.StatusOK,
+			expectedResponse:   func(i int) string { return fmt.Sprintf(`"re:%d"`, i) },
+		},
+		{
+			name: "Function error",
+			function: func(events []json.RawMessage) ([]byte, int) {
+				return []byte(`{"errorMessage":"boom"}`), http.StatusInternalServerError
+			},
+			expectedStatusCode: http.StatusInternalServerError,
+			expectedResponse:   func(i int) string { return `{"errorMessage":"boom"}` },
+		},
+		{
+			name: "Length mismatch",
+			function: func(events []json.RawMessage) ([]byte, int) {
+				return []byte(`[]`), http.StatusOK
+			},
+			expectedStatusCode: http.StatusBadGateway,
+			expectedResponse: func(i int) string {
+				return `{"errorType":"Runtime.InvalidResponse","errorMessage":"Batch response has 0 elements, expected 3"}`
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var invocations int
+			b, err := New(3, func(ctx context.Context, event []byte) ([]byte, int) {
+				invocations++
+				var events []json.RawMessage
+				if err := json.Unmarshal(event, &events); err != nil {
+					t.Fatalf("Function got non-array event %s", event)
+				}
+				return tt.function(events)
+			}, zap.NewNop().Sugar())
+			if err != nil {
+				t.Fatal(err)
+			}
+			b.Window = time.Second
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go b.Run(ctx)
+
+			var wg sync.WaitGroup
+			for i := 0; i < 3; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					response, statusCode := b.Invoke(context.Background(), []byte(fmt.Sprint(i)))
+					if statusCode != tt.expectedStatusCode {
+						t.Errorf("Got %d status code, want %d", statusCode, tt.expectedStatusCode)
+					}
+					if expected := tt.expectedResponse(i); string(response) != expected {
+						t.Errorf("Got %s response, want %s", response, expected)
+					}
+				}(i)
+			}
+			wg.Wait()
+			if invocations != 1 {
+				t.Errorf("Got %d invocations, want 1", invocations)
+			}
+		})
+	}
+}
+
+func TestInvokeWindow(t *testing.T) {
+	var sizes []int
+	b, err := New(10, func(ctx context.Context, event []byte) ([]byte, int) {
+		var events []json.RawMessage
+		_ = json.Unmarshal(event, &events)
+		sizes = append(sizes, len(events))
+		return []byte(`["ok"]`), http.StatusOK
+	}, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Window = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go b.Run(ctx)
+
+	start := time.Now()
+	if response, _ := b.Invoke(context.Background(), []byte(`{}`)); string(response) != `"ok"` {
+		t.Errorf("Got %s response, want %s", response, `"ok"`)
+	}
+	if elapsed := time.Since(start); elapsed < b.Window {
+		t.Errorf("Batch invoked after %s, before the window has passed", elapsed)
+	}
+	if len(sizes) != 1 || sizes[0] != 1 {
+		t.Errorf("Got %v batch sizes, want [1]", sizes)
+	}
+
+	// events that are not JSON skip the batching
+	if response, _ := b.Invoke(context.Background(), []byte(`plain text`)); string(response) != `["ok"]` {
+		t.Errorf("Got %s response of the non-JSON event", response)
+	}
+}
+
+func TestInvokeTrace(t *testing.T) {
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	parent := trace.ContextWithRemoteSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+	}))
+
+	var invoked trace.TraceID
+	b, err := New(2, func(ctx context.Context, event []byte) ([]byte, int) {
+		invoked = trace.SpanContextFromContext(ctx).TraceID()
+		return []byte(`["ok"]`), http.StatusOK
+	}, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Window = time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go b.Run(ctx)
+
+	b.Invoke(parent, []byte(`{}`))
+	if invoked != traceID {
+		t.Errorf("Got %s batch trace, want %s", invoked, traceID)
+	}
+}
+
+func TestInvokeStopped(t *testing.T) {
+	b, err := New(2, func(ctx context.Context, event []byte) ([]byte, int) {
+		return []byte(`["ok","ok"]`), http.StatusOK
+	}, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// requests are canceled while the batcher is not running
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, statusCode := b.Invoke(ctx, []byte(`{}`)); statusCode != http.StatusGatewayTimeout {
+		t.Errorf("Got %d status code of the canceled request, want %d", statusCode, http.StatusGatewayTimeout)
+	}
+
+	runCtx, stop := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		b.Run(runCtx)
+		close(stopped)
+	}()
+	stop()
+	<-stopped
+
+	result := make(chan int)
+	go func() {
+		_, statusCode := b.Invoke(context.Background(), []byte(`{}`))
+		result <- statusCode
+	}()
+	select {
+	case statusCode := <-result:
+		if statusCode != http.StatusServiceUnavailable {
+			t.Errorf("Got %d status code after the batcher is stopped, want %d", statusCode, http.StatusServiceUnavailable)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Invoke blocks after the batcher is stopped")
+	}
+}
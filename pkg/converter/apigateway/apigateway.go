@@ -16,5 +16,205 @@ limitations under the License.
 
 package apigateway
 
-// TODO: move logic from
-// https://github.com/triggermesh/aws-custom-runtime/blob/b3ec30de10c29b761fc1d89e9dd828d554c1ce0f/pkg/events/apigateway/mapper.go
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+
+	"github.com/triggermesh/aws-custom-runtime/pkg/converter"
+	"github.com/triggermesh/aws-custom-runtime/pkg/lambda"
+)
+
+const (
+	// Format is the converter name in the runtime configuration.
+	Format = "API_GATEWAY"
+
+	contentType      = "text/plain"
+	errorContentType = "application/json"
+
+	// Request context of the runtime API, which is exposed as the single
+	// greedy proxy resource of its own API.
+	apiID    = "custom-runtime"
+	stage    = "default"
+	resource = "/{proxy+}"
+)
+
+// APIGateway converts HTTP requests into the API Gateway proxy integration
+// events and decodes function responses into the HTTP responses.
+type APIGateway struct{}
+
+// Request is the API Gateway proxy integration event.
+type Request struct {
+	Resource                        string              `json:"resource"`
+	Path                            string              `json:"path"`
+	HTTPMethod                      string              `json:"httpMethod"`
+	Headers                         map[string]string   `json:"headers"`
+	MultiValueHeaders               map[string][]string `json:"multiValueHeaders"`
+	QueryStringParameters           map[string]string   `json:"queryStringParameters"`
+	MultiValueQueryStringParameters map[string][]string `json:"multiValueQueryStringParameters"`
+	PathParameters                  map[string]string   `json:"pathParameters"`
+	StageVariables                  map[string]string   `json:"stageVariables"`
+	RequestContext                  RequestContext      `json:"requestContext"`
+	Body                            string              `json:"body"`
+	IsBase64Encoded                 bool                `json:"isBase64Encoded"`
+}
+
+// RequestContext contains the information about the request origin.
+type RequestContext struct {
+	AccountID        string   `json:"accountId"`
+	ResourceID       string   `json:"resourceId"`
+	Stage            string   `json:"stage"`
+	RequestID        string   `json:"requestId"`
+	Identity         Identity `json:"identity"`
+	ResourcePath     string   `json:"resourcePath"`
+	HTTPMethod       string   `json:"httpMethod"`
+	APIID            string   `json:"apiId"`
+	Path             string   `json:"path"`
+	Protocol         string   `json:"protocol"`
+	RequestTimeEpoch int64    `json:"requestTimeEpoch"`
+}
+
+// Identity is the request caller identity.
+type Identity struct {
+	SourceIP  string `json:"sourceIp"`
+	UserAgent string `json:"userAgent"`
+}
+
+// Response is the API Gateway proxy integration response.
+type Response struct {
+	StatusCode        int                 `json:"statusCode"`
+	Headers           map[string]string   `json:"headers"`
+	MultiValueHeaders map[string][]string `json:"multiValueHeaders"`
+	Body              string              `json:"body"`
+	IsBase64Encoded   bool                `json:"isBase64Encoded"`
+}
+
+type errorResponse struct {
+	Message string `json:"message"`
+}
+
+func init() {
+	converter.Register(Format, func() (converter.Converter, error) {
+		return New()
+	})
+}
+
+func New() (*APIGateway, error) {
+	return &APIGateway{}, nil
+}
+
+func (a *APIGateway) Request(request []byte, r *http.Request) ([]byte, map[string]string, error) {
+	event := Request{
+		Resource:                        resource,
+		Path:                            r.URL.Path,
+		HTTPMethod:                      r.Method,
+		Headers:                         make(map[string]string, len(r.Header)),
+		MultiValueHeaders:               r.Header,
+		QueryStringParameters:           make(map[string]string),
+		MultiValueQueryStringParameters: r.URL.Query(),
+		PathParameters: map[string]string{
+			"proxy": strings.TrimPrefix(r.URL.Path, "/"),
+		},
+		RequestContext: RequestContext{
+			AccountID:    lambda.Account,
+			ResourceID:   resource,
+			Stage:        stage,
+			RequestID:    uuid.NewString(),
+			ResourcePath: resource,
+			HTTPMethod:   r.Method,
+			APIID:        apiID,
+			Path:         r.URL.Path,
+			Protocol:     r.Proto,
+			Identity: Identity{
+				SourceIP:  sourceIP(r),
+				UserAgent: r.UserAgent(),
+			},
+			RequestTimeEpoch: time.Now().UnixMilli(),
+		},
+	}
+
+	for k, v := range r.Header {
+		event.Headers[k] = strings.Join(v, ",")
+	}
+	for k, v := range event.MultiValueQueryStringParameters {
+		event.QueryStringParameters[k] = v[len(v)-1]
+	}
+
+	if utf8.Valid(request) {
+		event.Body = string(request)
+	} else {
+		event.Body = base64.StdEncoding.EncodeToString(request)
+		event.IsBase64Encoded = true
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot encode API Gateway event: %w", err)
+	}
+	return body, nil, nil
+}
+
+// Response decodes the API Gateway proxy response into its status code, headers
+// and body. Function responses that are not in the proxy response format are
+// returned as is.
+func (a *APIGateway) Response(data []byte, _ map[string]string) (*converter.Response, error) {
+	var response Response
+	if err := json.Unmarshal(data, &response); err != nil || response.StatusCode == 0 {
+		return converter.NewResponse(data, contentType), nil
+	}
+	body := []byte(response.Body)
+	if response.IsBase64Encoded {
+		var err error
+		if body, err = base64.StdEncoding.DecodeString(response.Body); err != nil {
+			return nil, fmt.Errorf("cannot decode response body: %w", err)
+		}
+	}
+	resp := converter.NewResponse(body, contentType)
+	resp.StatusCode = response.StatusCode
+	for k, v := range response.Headers {
+		resp.Header.Set(k, v)
+	}
+	// multi-value headers take precedence, the same way as in API Gateway
+	for k, values := range response.MultiValueHeaders {
+		resp.Header.Del(k)
+		for _, v := range values {
+			resp.Header.Add(k, v)
+		}
+	}
+	return resp, nil
+}
+
+// Error renders the API Gateway error body. Function errors and timeouts are
+// reported as 502 and 504 responses without exposing the error details.
+func (a *APIGateway) Error(e *converter.Error, _ map[string]string) (*converter.Response, error) {
+	statusCode, message := e.StatusCode, e.Message
+	switch {
+	case e.Type == converter.ErrorTypeTimeout:
+		statusCode, message = http.StatusGatewayTimeout, "Endpoint request timed out"
+	case statusCode >= http.StatusInternalServerError:
+		statusCode, message = http.StatusBadGateway, "Internal server error"
+	}
+	body, err := json.Marshal(errorResponse{Message: message})
+	if err != nil {
+		return nil, fmt.Errorf("cannot encode error response: %w", err)
+	}
+	resp := converter.NewResponse(body, errorContentType)
+	resp.StatusCode = statusCode
+	return resp, nil
+}
+
+func sourceIP(r *http.Request) string {
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+	}
+	if i := strings.LastIndex(r.RemoteAddr, ":"); i != -1 {
+		return r.RemoteAddr[:i]
+	}
+	return r.RemoteAddr
+}
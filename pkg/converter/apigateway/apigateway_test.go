@@ -0,0 +1,181 @@
+package apigateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/triggermesh/aws-custom-runtime/pkg/converter"
+)
+
+func TestAPIGateway_Request(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/foo/bar?a=1&a=2&b=3", nil)
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("X-Forwarded-For", "10.0.0.1, 10.0.0.2")
+
+	a := &APIGateway{}
+	data, context, err := a.Request([]byte(`{"foo":"bar"}`), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if context != nil {
+		t.Errorf("Request() got context %v, want nil", context)
+	}
+
+	var event Request
+	if err := json.Unmarshal(data, &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.HTTPMethod != http.MethodPost || event.Path != "/foo/bar" {
+		t.Errorf("Got %s %s request, expecting POST /foo/bar", event.HTTPMethod, event.Path)
+	}
+	if event.PathParameters["proxy"] != "foo/bar" {
+		t.Errorf("Got %q proxy path parameter", event.PathParameters["proxy"])
+	}
+	if event.QueryStringParameters["a"] != "2" || len(event.MultiValueQueryStringParameters["a"]) != 2 {
+		t.Errorf("Got %v query parameters", event.MultiValueQueryStringParameters)
+	}
+	if event.Headers["Content-Type"] != "application/json" {
+		t.Errorf("Got %v headers", event.Headers)
+	}
+	if event.RequestContext.Identity.SourceIP != "10.0.0.1" {
+		t.Errorf("Got %q source IP, expecting %q", event.RequestContext.Identity.SourceIP, "10.0.0.1")
+	}
+	if event.Body != `{"foo":"bar"}` || event.IsBase64Encoded {
+		t.Errorf("Got %q body, base64 %v", event.Body, event.IsBase64Encoded)
+	}
+
+	data, _, err = a.Request([]byte{0xff, 0xfe}, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Body != "//4=" || !event.IsBase64Encoded {
+		t.Errorf("Got %q body, base64 %v", event.Body, event.IsBase64Encoded)
+	}
+}
+
+func TestAPIGateway_Response(t *testing.T) {
+	tests := []struct {
+		name               string
+		response           string
+		expected           string
+		expectedStatusCode int
+		expectedHeader     http.Header
+		wantErr            bool
+	}{
+		{
+			name:               "Proxy response",
+			response:           `{"statusCode":200,"body":"{\"foo\":\"bar\"}"}`,
+			expected:           `{"foo":"bar"}`,
+			expectedStatusCode: http.StatusOK,
+			expectedHeader:     http.Header{"Content-Type": {"text/plain"}},
+		},
+		{
+			name:               "Non-200 status",
+			response:           `{"statusCode":404,"headers":{"Content-Type":"application/json"},"body":"{\"message\":\"not found\"}"}`,
+			expected:           `{"message":"not found"}`,
+			expectedStatusCode: http.StatusNotFound,
+			expectedHeader:     http.Header{"Content-Type": {"application/json"}},
+		},
+		{
+			name:               "Headers",
+			response:           `{"statusCode":201,"headers":{"location":"/orders/1","x-single":"a"},"multiValueHeaders":{"set-cookie":["a=1","b=2"],"x-single":["b"]},"body":""}`,
+			expected:           ``,
+			expectedStatusCode: http.StatusCreated,
+			expectedHeader: http.Header{
+				"Content-Type": {"text/plain"},
+				"Location":     {"/orders/1"},
+				"Set-Cookie":   {"a=1", "b=2"},
+				"X-Single":     {"b"},
+			},
+		},
+		{
+			name:               "Base64 encoded body",
+			response:           `{"statusCode":200,"headers":{"Content-Type":"application/octet-stream"},"body":"aGVsbG8=","isBase64Encoded":true}`,
+			expected:           `hello`,
+			expectedStatusCode: http.StatusOK,
+			expectedHeader:     http.Header{"Content-Type": {"application/octet-stream"}},
+		},
+		{
+			name:     "Invalid base64 body",
+			response: `{"statusCode":200,"body":"!","isBase64Encoded":true}`,
+			wantErr:  true,
+		},
+		{
+			name:           "Not a proxy response",
+			response:       `{"foo":"bar"}`,
+			expected:       `{"foo":"bar"}`,
+			expectedHeader: http.Header{"Content-Type": {"text/plain"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &APIGateway{}
+			resp, err := a.Response([]byte(tt.response), nil)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Response() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				return
+			}
+			if !bytes.Equal(resp.Body, []byte(tt.expected)) {
+				t.Errorf("Response() got = %s, want %s", resp.Body, tt.expected)
+			}
+			if resp.StatusCode != tt.expectedStatusCode {
+				t.Errorf("Response() got %d status code, want %d", resp.StatusCode, tt.expectedStatusCode)
+			}
+			if !reflect.DeepEqual(resp.Header, tt.expectedHeader) {
+				t.Errorf("Response() got %v headers, want %v", resp.Header, tt.expectedHeader)
+			}
+		})
+	}
+}
+
+func TestAPIGateway_Error(t *testing.T) {
+	tests := []struct {
+		name               string
+		err                *converter.Error
+		expectedBody       string
+		expectedStatusCode int
+	}{
+		{
+			name:               "Function error",
+			err:                &converter.Error{Type: "ValueError", Message: "secret details", StatusCode: http.StatusInternalServerError},
+			expectedBody:       `{"message":"Internal server error"}`,
+			expectedStatusCode: http.StatusBadGateway,
+		},
+		{
+			name:               "Timeout",
+			err:                &converter.Error{Type: converter.ErrorTypeTimeout, Message: "Task timed out", StatusCode: http.StatusGone},
+			expectedBody:       `{"message":"Endpoint request timed out"}`,
+			expectedStatusCode: http.StatusGatewayTimeout,
+		},
+		{
+			name:               "Request error",
+			err:                &converter.Error{Type: converter.ErrorTypeRequestTooLarge, Message: "Too large", StatusCode: http.StatusRequestEntityTooLarge},
+			expectedBody:       `{"message":"Too large"}`,
+			expectedStatusCode: http.StatusRequestEntityTooLarge,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &APIGateway{}
+			resp, err := a.Error(tt.err, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(resp.Body) != tt.expectedBody || resp.StatusCode != tt.expectedStatusCode {
+				t.Errorf("Error() got = %d %s, want %d %s", resp.StatusCode, resp.Body, tt.expectedStatusCode, tt.expectedBody)
+			}
+		})
+	}
+}
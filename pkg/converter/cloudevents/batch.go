@@ -0,0 +1,201 @@
+/*
+Copyright 2023 Triggermesh Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloudevents
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/cloudevents/sdk-go/v2/binding"
+	cehttp "github.com/cloudevents/sdk-go/v2/protocol/http"
+
+	"github.com/triggermesh/aws-custom-runtime/pkg/converter"
+)
+
+// CloudEvents batch constant attributes.
+const (
+	BatchContentType = "application/cloudevents-batch+json"
+	// BatchContextKey marks the array invocation of the batched events.
+	BatchContextKey = "Lambda-Runtime-Cloudevents-Batch"
+)
+
+// Batched events invocation modes.
+const (
+	BatchModeSplit = "split"
+	BatchModeArray = "array"
+)
+
+// SplitBatch converts batched events into separate invocations or,
+// in array mode, into one invocation with the array of events data.
+func (ce *CloudEvent) SplitBatch(request []byte, r *http.Request) ([]converter.Item, bool, error) {
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), BatchContentType) {
+		return nil, false, nil
+	}
+
+	var events []json.RawMessage
+	if err := json.Unmarshal(request, &events); err != nil {
+		return nil, true, fmt.Errorf("cannot unmarshal events batch: %w", err)
+	}
+	if len(events) == 0 {
+		return nil, true, fmt.Errorf("events batch is empty")
+	}
+
+	items := make([]converter.Item, len(events))
+	contexts := make([]map[string]string, len(events))
+	for i, event := range events {
+		body, context, err := parseStructuredCE(event)
+		if err != nil {
+			return nil, true, fmt.Errorf("structured CloudEvent %d parse error: %w", i, err)
+		}
+		if ce.ValidateInbound {
+			if err := ce.validateRequest(context, body); err != nil {
+				return nil, true, invalidRequest(event, http.Header{"Content-Type": {ContentType}},
+					fmt.Errorf("batched event %d: %w", i, err))
+			}
+		}
+		items[i].Data, contexts[i] = body, context
+	}
+
+	if ce.BatchMode == BatchModeArray {
+		data := make([]interface{}, len(items))
+		for i, item := range items {
+			data[i] = string(item.Data)
+			if json.Valid(item.Data) {
+				data[i] = json.RawMessage(item.Data)
+			}
+		}
+		body, err := json.Marshal(data)
+		if err != nil {
+			return nil, true, fmt.Errorf("cannot encode events data array: %w", err)
+		}
+		runtimeContext, err := newRuntimeContext(contexts)
+		if err != nil {
+			return nil, true, err
+		}
+		runtimeContext[BatchContextKey] = "true"
+		return []converter.Item{{Data: body, Context: runtimeContext}}, true, nil
+	}
+
+	for i := range items {
+		runtimeContext, err := newRuntimeContext(contexts[i])
+		if err != nil {
+			return nil, true, err
+		}
+		items[i].Context = runtimeContext
+	}
+	return items, true, nil
+}
+
+// JoinBatch combines response events into the batch. The batch is returned
+// with the status of the failed invocations only if all of them failed.
+// Original responses are kept as the batch parts to be delivered separately.
+func (ce *CloudEvent) JoinBatch(responses []*converter.Response) (*converter.Response, error) {
+	events := make([]json.RawMessage, 0, len(responses))
+	parts := make([]*converter.Response, 0, len(responses))
+	statusCode := 0
+	for _, resp := range responses {
+		switch {
+		case resp.StatusCode < http.StatusBadRequest:
+			statusCode = http.StatusOK
+		case statusCode == 0:
+			statusCode = resp.StatusCode
+		}
+
+		if len(resp.Body) == 0 {
+			continue
+		}
+		if resp.Header.Get("Content-Type") == BatchContentType {
+			var batch []json.RawMessage
+			if err := json.Unmarshal(resp.Body, &batch); err != nil {
+				return nil, fmt.Errorf("cannot decode response batch: %w", err)
+			}
+			events = append(events, batch...)
+			parts = append(parts, resp.Parts...)
+			continue
+		}
+		event, err := structured(resp)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+		parts = append(parts, resp)
+	}
+	if statusCode == 0 {
+		statusCode = http.StatusOK
+	}
+
+	if len(events) == 0 {
+		return &converter.Response{StatusCode: statusCode}, nil
+	}
+	body, err := json.Marshal(events)
+	if err != nil {
+		return nil, fmt.Errorf("cannot encode response batch: %w", err)
+	}
+	resp := converter.NewResponse(body, BatchContentType)
+	resp.StatusCode = statusCode
+	resp.Parts = parts
+	return resp, nil
+}
+
+// batchResponse renders the array invocation response into the batch of
+// events. Elements of the array response correlate with the inbound events
+// by their index, other responses are returned as a single event batch.
+func (ce *CloudEvent) batchResponse(data []byte, context map[string]string) (*converter.Response, error) {
+	var contexts []map[string]string
+	_ = json.Unmarshal([]byte(context[CeContextKey]), &contexts)
+
+	var elements []json.RawMessage
+	if err := json.Unmarshal(data, &elements); err != nil {
+		elements = []json.RawMessage{data}
+	}
+
+	responses := make([]*converter.Response, 0, len(elements))
+	for i, element := range elements {
+		var elementContext map[string]string
+		if len(elements) == len(contexts) {
+			runtimeContext, err := newRuntimeContext(contexts[i])
+			if err != nil {
+				return nil, err
+			}
+			elementContext = runtimeContext
+		}
+		resp, err := ce.response(element, elementContext)
+		if err != nil {
+			return nil, err
+		}
+		responses = append(responses, resp)
+	}
+	return ce.JoinBatch(responses)
+}
+
+// structured returns the response event in the structured mode.
+func structured(resp *converter.Response) ([]byte, error) {
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), ContentType) {
+		return resp.Body, nil
+	}
+	message := cehttp.NewMessage(resp.Header, ioutil.NopCloser(bytes.NewReader(resp.Body)))
+	event, err := binding.ToEvent(context.Background(), message)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read binary response event: %w", err)
+	}
+	return event.MarshalJSON()
+}
@@ -18,22 +18,40 @@ package cloudevents
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"strings"
+	"text/template"
 	"time"
 
 	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/types"
 	"github.com/google/uuid"
 	"github.com/kelseyhightower/envconfig"
+
+	"github.com/triggermesh/aws-custom-runtime/pkg/converter"
 )
 
+// Format is the converter name in the runtime configuration.
+const Format = "CLOUDEVENTS"
+
 // CloudEvents request constant attributes.
 const (
 	ContentType      = "application/cloudevents+json"
 	CeContextKey     = "Lambda-Runtime-Cloudevents-Context"
 	ClientContextKey = "Lambda-Runtime-Client-Context"
+
+	errorTypeExtension     = "errortype"
+	causationIDExtension   = "causationid"
+	correlationIDExtension = "correlationid"
+)
+
+// Response events content modes.
+const (
+	ContentModeStructured = "structured"
+	ContentModeBinary     = "binary"
 )
 
 // CloudEvent is a data structure required to map KLR responses to cloudevents
@@ -41,14 +59,54 @@ type CloudEvent struct {
 	// FunctionResponseMode describes what data is returned from the function:
 	// only data payload or full event in binary format
 	FunctionResponseMode string `envconfig:"function_response_mode" default:"data"`
+	// ContentMode describes how response events are encoded:
+	// "structured" JSON or "binary" with the attributes in ce-* headers
+	ContentMode string `envconfig:"content_mode" default:"structured"`
+	// PropagateExtensions lists the inbound event extensions copied to the response events
+	PropagateExtensions []string `envconfig:"propagate_extensions"`
+	// Correlation enables causationid and correlationid extensions
+	// pointing at the inbound event
+	Correlation bool `envconfig:"correlation" default:"false"`
+	// BatchMode describes how batched events are invoked: "split" into
+	// separate invocations or as a single "array" invocation
+	BatchMode string `envconfig:"batch_mode" default:"split"`
+	// ValidateInbound rejects inbound events with missing required
+	// attributes, unsupported spec version or data not matching the schema
+	ValidateInbound bool `envconfig:"validate_inbound" default:"false"`
+	// ValidateOutbound applies the same validation to the response events
+	ValidateOutbound bool `envconfig:"validate_outbound" default:"false"`
+	// ValidateDataSchema validates event data against the JSON Schema
+	// referenced by the dataschema attribute
+	ValidateDataSchema bool `envconfig:"validate_dataschema" default:"false"`
+	// DataSchemaAllowlist lists the location prefixes of the schemas that
+	// may be referenced by the dataschema attribute
+	DataSchemaAllowlist []string `envconfig:"dataschema_allowlist"`
+	// Schemas maps event types to their data JSON Schema locations
+	Schemas map[string]string `envconfig:"schemas"`
 
 	Overrides Overrides `envconfig:"overrides"`
+
+	templates *templates
+	schemas   *schemas
 }
 
+// Overrides are the response event attributes. Values are Go templates
+// rendered with the inbound event context as .Request and the function
+// response as .Data, e.g. `{{ .Request.subject }}` or `{{ env "K_SERVICE" }}`.
 type Overrides struct {
 	EventType string `envconfig:"type" default:"ce.klr.triggermesh.io"`
 	Source    string `envconfig:"source" default:"knative-lambda-runtime"`
 	Subject   string `envconfig:"subject" default:"klr-response"`
+	// ErrorType is the type of events that carry runtime and function errors
+	ErrorType string `envconfig:"error_type" default:"ce.klr.triggermesh.io.error"`
+	// Extensions are the extension attributes added to the response events
+	Extensions map[string]string `envconfig:"extensions"`
+}
+
+func init() {
+	converter.Register(Format, func() (converter.Converter, error) {
+		return New()
+	})
 }
 
 func New() (*CloudEvent, error) {
@@ -56,23 +114,81 @@ func New() (*CloudEvent, error) {
 	if err := envconfig.Process("ce", &ce); err != nil {
 		return nil, fmt.Errorf("cannot process CloudEvent env variables: %v", err)
 	}
+	if ce.ContentMode != ContentModeStructured && ce.ContentMode != ContentModeBinary {
+		return nil, fmt.Errorf("unknown CloudEvent content mode %q", ce.ContentMode)
+	}
+	if ce.BatchMode != BatchModeSplit && ce.BatchMode != BatchModeArray {
+		return nil, fmt.Errorf("unknown CloudEvent batch mode %q", ce.BatchMode)
+	}
+	templates, err := newTemplates(ce.Overrides)
+	if err != nil {
+		return nil, err
+	}
+	ce.templates = templates
+	ce.schemas = newSchemas()
+	for _, location := range ce.Schemas {
+		if _, err := ce.schemas.get(location, true); err != nil {
+			return nil, err
+		}
+	}
 	return &ce, nil
 }
 
-func (ce *CloudEvent) Response(data []byte) ([]byte, error) {
+func (ce *CloudEvent) Response(data []byte, context map[string]string) (*converter.Response, error) {
+	resp, err := ce.response(data, context)
+	if err != nil {
+		return nil, err
+	}
+	return ce.validated(resp)
+}
+
+// validated returns the response or, if outbound validation is enabled
+// and the response event is invalid, the validation error.
+func (ce *CloudEvent) validated(resp *converter.Response) (*converter.Response, error) {
+	if !ce.ValidateOutbound {
+		return resp, nil
+	}
+	if err := ce.validateResponse(resp); err != nil {
+		return nil, &converter.InvalidEventError{Event: resp, Err: err}
+	}
+	return resp, nil
+}
+
+func (ce *CloudEvent) response(data []byte, context map[string]string) (*converter.Response, error) {
 	if len(data) == 0 {
-		return nil, nil
+		return &converter.Response{}, nil
+	}
+
+	if _, batch := context[BatchContextKey]; batch {
+		return ce.batchResponse(data, context)
 	}
 
 	if ce.FunctionResponseMode == "event" {
-		return ce.fillInContext(data)
+		var events []json.RawMessage
+		if err := json.Unmarshal(data, &events); err != nil {
+			return ce.eventResponse(data, context)
+		}
+		responses := make([]*converter.Response, len(events))
+		for i, event := range events {
+			resp, err := ce.eventResponse(event, context)
+			if err != nil {
+				return nil, fmt.Errorf("function response event %d: %w", i, err)
+			}
+			responses[i] = resp
+		}
+		return ce.JoinBatch(responses)
 	}
 
 	// If response format is set to CloudEvents
 	// and CE_TYPE is empty,
 	// then reply with the empty response
 	if ce.Overrides.EventType == "" {
-		return nil, nil
+		return &converter.Response{}, nil
+	}
+
+	attrs, err := ce.attributes(ce.templates.eventType, context, data)
+	if err != nil {
+		return nil, err
 	}
 
 	var body interface{}
@@ -90,16 +206,148 @@ func (ce *CloudEvent) Response(data []byte) ([]byte, error) {
 		body = string(data)
 	}
 
+	event, err := newEvent(attrs)
+	if err != nil {
+		return nil, err
+	}
+	event.SetData(contentType, body)
+	return ce.encode(event)
+}
+
+// eventResponse fills in the missing attributes of the event returned by the function.
+func (ce *CloudEvent) eventResponse(data []byte, context map[string]string) (*converter.Response, error) {
+	attrs, err := ce.attributes(ce.templates.eventType, context, data)
+	if err != nil {
+		return nil, err
+	}
+	data, err = ce.fillInContext(data, attrs)
+	if err != nil {
+		return nil, err
+	}
+	if ce.ContentMode == ContentModeStructured {
+		return converter.NewResponse(data, ContentType), nil
+	}
+	event := cloudevents.NewEvent()
+	if err := event.UnmarshalJSON(data); err != nil {
+		return nil, fmt.Errorf("cannot decode function response event: %w", err)
+	}
+	return ce.encode(event)
+}
+
+// Error wraps Lambda error into the CloudEvent of the error type.
+func (ce *CloudEvent) Error(e *converter.Error, context map[string]string) (*converter.Response, error) {
+	attrs, err := ce.attributes(ce.templates.errorType, context, e.JSON())
+	if err != nil {
+		return nil, err
+	}
+	// error data does not match the schema of the inbound event data
+	attrs.dataSchema = ""
+	event, err := newEvent(attrs)
+	if err != nil {
+		return nil, err
+	}
+	event.SetExtension(errorTypeExtension, e.Type)
+	if err := event.SetData(cloudevents.ApplicationJSON, e); err != nil {
+		return nil, fmt.Errorf("cannot set error event data: %w", err)
+	}
+	resp, err := ce.encode(event)
+	if err != nil {
+		return nil, err
+	}
+	resp.StatusCode = e.StatusCode
+	return ce.validated(resp)
+}
+
+// attributes renders the response event attributes and carries over
+// the inbound event extensions, correlation attributes and data schema.
+func (ce *CloudEvent) attributes(eventType *template.Template, context map[string]string, data []byte) (*attributes, error) {
+	request := requestAttributes(context)
+	attrs, err := ce.templates.render(eventType, request, data)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range ce.PropagateExtensions {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if value := request[name]; value != "" && attrs.extensions[name] == "" {
+			attrs.extensions[name] = value
+		}
+	}
+	if id := request["id"]; ce.Correlation && id != "" {
+		attrs.extensions[causationIDExtension] = id
+		attrs.extensions[correlationIDExtension] = id
+		if correlationID := request[correlationIDExtension]; correlationID != "" {
+			attrs.extensions[correlationIDExtension] = correlationID
+		}
+	}
+	attrs.dataSchema = request["dataschema"]
+	return attrs, nil
+}
+
+// newEvent creates the response event with the rendered attributes.
+func newEvent(attrs *attributes) (cloudevents.Event, error) {
 	event := cloudevents.NewEvent(cloudevents.VersionV1)
+	if attrs.eventType == "" || attrs.source == "" {
+		return event, fmt.Errorf("response event type and source must not be empty")
+	}
 	event.SetID(uuid.NewString())
-	event.SetType(ce.Overrides.EventType)
+	event.SetType(attrs.eventType)
 	event.SetTime(time.Now())
-	event.SetSource(ce.Overrides.Source)
-	event.SetData(contentType, body)
-	return event.MarshalJSON()
+	event.SetSource(attrs.source)
+	if attrs.subject != "" {
+		event.SetSubject(attrs.subject)
+	}
+	if attrs.dataSchema != "" {
+		event.SetDataSchema(attrs.dataSchema)
+	}
+	for name, value := range attrs.extensions {
+		if value != "" {
+			event.SetExtension(name, value)
+		}
+	}
+	return event, nil
 }
 
-func (ce *CloudEvent) fillInContext(data []byte) ([]byte, error) {
+// encode renders the event in the configured content mode.
+func (ce *CloudEvent) encode(event cloudevents.Event) (*converter.Response, error) {
+	if ce.ContentMode == ContentModeBinary {
+		return binary(event)
+	}
+	data, err := event.MarshalJSON()
+	if err != nil {
+		return nil, fmt.Errorf("cannot encode response event: %w", err)
+	}
+	return converter.NewResponse(data, ContentType), nil
+}
+
+// binary puts event attributes into the ce-* headers and
+// leaves event data as the response body.
+func binary(event cloudevents.Event) (*converter.Response, error) {
+	resp := converter.NewResponse(event.Data(), event.DataContentType())
+	resp.Header.Set("ce-specversion", event.SpecVersion())
+	resp.Header.Set("ce-id", event.ID())
+	resp.Header.Set("ce-type", event.Type())
+	resp.Header.Set("ce-source", event.Source())
+	if subject := event.Subject(); subject != "" {
+		resp.Header.Set("ce-subject", subject)
+	}
+	if dataSchema := event.DataSchema(); dataSchema != "" {
+		resp.Header.Set("ce-dataschema", dataSchema)
+	}
+	if t := event.Time(); !t.IsZero() {
+		resp.Header.Set("ce-time", t.UTC().Format(time.RFC3339Nano))
+	}
+	for name, value := range event.Extensions() {
+		v, err := types.Format(value)
+		if err != nil {
+			return nil, fmt.Errorf("cannot format %q extension: %w", name, err)
+		}
+		resp.Header.Set("ce-"+name, v)
+	}
+	return resp, nil
+}
+
+func (ce *CloudEvent) fillInContext(data []byte, attrs *attributes) ([]byte, error) {
 	var event map[string]interface{}
 	if err := json.Unmarshal(data, &event); err != nil {
 		return nil, fmt.Errorf("cannot unmarshal function response into binary CE: %w", err)
@@ -109,10 +357,21 @@ func (ce *CloudEvent) fillInContext(data []byte) ([]byte, error) {
 		event["id"] = uuid.NewString()
 	}
 	if _, set := event["type"]; !set {
-		event["type"] = ce.Overrides.EventType
+		event["type"] = attrs.eventType
 	}
 	if _, set := event["source"]; !set {
-		event["source"] = ce.Overrides.Source
+		event["source"] = attrs.source
+	}
+	if _, set := event["subject"]; !set && attrs.subject != "" {
+		event["subject"] = attrs.subject
+	}
+	if _, set := event["dataschema"]; !set && attrs.dataSchema != "" {
+		event["dataschema"] = attrs.dataSchema
+	}
+	for name, value := range attrs.extensions {
+		if _, set := event[name]; !set && value != "" {
+			event[name] = value
+		}
 	}
 	if _, set := event["specversion"]; !set {
 		event["specversion"] = cloudevents.VersionV1
@@ -123,57 +382,121 @@ func (ce *CloudEvent) fillInContext(data []byte) ([]byte, error) {
 	return json.Marshal(event)
 }
 
-func (ce *CloudEvent) Request(request []byte, headers http.Header) ([]byte, map[string]string, error) {
+func (ce *CloudEvent) Request(request []byte, r *http.Request) ([]byte, map[string]string, error) {
 	var context map[string]string
 	var body []byte
 	var err error
 
+	headers := r.Header
 	contentType := headers.Get("Content-Type")
 
 	if strings.HasPrefix(contentType, "application/cloudevents+json") {
 		if body, context, err = parseStructuredCE(request); err != nil {
 			return nil, nil, fmt.Errorf("structured CloudEvent parse error: %w", err)
 		}
-	} else if strings.HasPrefix(contentType, "application/json") {
+	} else if headers.Get("ce-specversion") != "" || strings.HasPrefix(contentType, "application/json") {
 		body = request
 		context = parseBinaryCE(headers)
 	} else {
-		return request, nil, nil
+		body = request
+	}
+
+	if ce.ValidateInbound {
+		if err := ce.validateRequest(context, body); err != nil {
+			return nil, nil, invalidRequest(request, headers, err)
+		}
+	}
+	if context == nil {
+		return body, nil, nil
+	}
+
+	runtimeContext, err := newRuntimeContext(context)
+	if err != nil {
+		return nil, nil, err
 	}
+	return body, runtimeContext, nil
+}
 
+// newRuntimeContext passes inbound event attributes to the function
+// in the Lambda client context.
+func newRuntimeContext(context interface{}) (map[string]string, error) {
 	ceContext, err := json.Marshal(context)
 	if err != nil {
-		return nil, nil, fmt.Errorf("cannot encode request event context: %w", err)
+		return nil, fmt.Errorf("cannot encode request event context: %w", err)
 	}
 
-	runtimeContext := map[string]string{
+	return map[string]string{
 		ClientContextKey: fmt.Sprintf("{\"custom\":%s}", ceContext),
 		CeContextKey:     string(ceContext),
-	}
-
-	return body, runtimeContext, nil
+	}, nil
 }
 
 func parseStructuredCE(body []byte) ([]byte, map[string]string, error) {
-	var event map[string]interface{}
+	var event map[string]json.RawMessage
 	if err := json.Unmarshal(body, &event); err != nil {
 		return nil, nil, fmt.Errorf("cannot unmarshal body: %w", err)
 	}
 
-	data, err := json.Marshal(event["data"])
+	data, err := structuredData(event)
 	if err != nil {
-		return nil, nil, fmt.Errorf("cannot marshal body: %w", err)
+		return nil, nil, fmt.Errorf("cannot read event data: %w", err)
 	}
 
 	delete(event, "data")
+	delete(event, "data_base64")
 	headers := make(map[string]string, len(event))
 	for k, v := range event {
-		headers[k] = fmt.Sprintf("%v", v)
+		var value interface{}
+		if err := json.Unmarshal(v, &value); err != nil {
+			return nil, nil, fmt.Errorf("cannot unmarshal %q attribute: %w", k, err)
+		}
+		headers[k] = fmt.Sprintf("%v", value)
 	}
 
 	return data, headers, nil
 }
 
+// structuredData returns the event data in its original bytes: decoded
+// "data_base64", unquoted "data" string of non-JSON content types or
+// the "data" JSON value as is.
+func structuredData(event map[string]json.RawMessage) ([]byte, error) {
+	if encoded, set := event["data_base64"]; set {
+		var data string
+		if err := json.Unmarshal(encoded, &data); err != nil {
+			return nil, fmt.Errorf("data_base64 is not a string: %w", err)
+		}
+		return base64.StdEncoding.DecodeString(data)
+	}
+
+	data, set := event["data"]
+	if !set {
+		return nil, nil
+	}
+	var contentType string
+	if ct, set := event["datacontenttype"]; set {
+		if err := json.Unmarshal(ct, &contentType); err != nil {
+			return nil, fmt.Errorf("datacontenttype is not a string: %w", err)
+		}
+	}
+	if !isJSON(contentType) {
+		var text string
+		if err := json.Unmarshal(data, &text); err == nil {
+			return []byte(text), nil
+		}
+	}
+	return data, nil
+}
+
+// isJSON checks if the media type is JSON, empty content type
+// of structured events defaults to JSON.
+func isJSON(contentType string) bool {
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	return mediaType == "" ||
+		mediaType == "application/json" ||
+		mediaType == "text/json" ||
+		strings.HasSuffix(mediaType, "+json")
+}
+
 func parseBinaryCE(headers http.Header) map[string]string {
 	h := make(map[string]string)
 	for k, v := range headers {
@@ -182,9 +505,9 @@ func parseBinaryCE(headers http.Header) map[string]string {
 			h[k[3:]] = strings.Join(v, ",")
 		}
 	}
+	// Content-Type of binary events carries datacontenttype attribute
+	if contentType := headers.Get("Content-Type"); contentType != "" && h["specversion"] != "" {
+		h["datacontenttype"] = contentType
+	}
 	return h
 }
-
-func (ce *CloudEvent) ContentType() string {
-	return ContentType
-}
@@ -1,9 +1,17 @@
 package cloudevents
 
 import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
 	"net/http"
+	"path/filepath"
 	"reflect"
 	"testing"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+
+	"github.com/triggermesh/aws-custom-runtime/pkg/converter"
 )
 
 func TestCloudEvent_Request(t *testing.T) {
@@ -40,6 +48,64 @@ func TestCloudEvent_Request(t *testing.T) {
 				ClientContextKey: `{"custom":{"source":"test"}}`,
 			},
 		},
+		{
+			name:    "Structured event with text data",
+			request: `{"source":"test","datacontenttype":"text/plain","data":"hello world"}`,
+			headers: http.Header{
+				"Content-Type": {"application/cloudevents+json"},
+			},
+			expectedBody: `hello world`,
+			expectedRuntimeContext: map[string]string{
+				CeContextKey:     `{"datacontenttype":"text/plain","source":"test"}`,
+				ClientContextKey: `{"custom":{"datacontenttype":"text/plain","source":"test"}}`,
+			},
+		},
+		{
+			name:    "Structured event with JSON string data",
+			request: `{"source":"test","data":"hello world"}`,
+			headers: http.Header{
+				"Content-Type": {"application/cloudevents+json"},
+			},
+			expectedBody: `"hello world"`,
+			expectedRuntimeContext: map[string]string{
+				CeContextKey:     `{"source":"test"}`,
+				ClientContextKey: `{"custom":{"source":"test"}}`,
+			},
+		},
+		{
+			name:    "Structured event with base64 data",
+			request: `{"source":"test","datacontenttype":"application/octet-stream","data_base64":"AAEC/w=="}`,
+			headers: http.Header{
+				"Content-Type": {"application/cloudevents+json"},
+			},
+			expectedBody: "\x00\x01\x02\xff",
+			expectedRuntimeContext: map[string]string{
+				CeContextKey:     `{"datacontenttype":"application/octet-stream","source":"test"}`,
+				ClientContextKey: `{"custom":{"datacontenttype":"application/octet-stream","source":"test"}}`,
+			},
+		},
+		{
+			name:    "Structured event with invalid base64 data",
+			request: `{"source":"test","data_base64":"!"}`,
+			headers: http.Header{
+				"Content-Type": {"application/cloudevents+json"},
+			},
+			wantErr: true,
+		},
+		{
+			name:    "Binary event with XML data",
+			request: `<foo>bar</foo>`,
+			headers: http.Header{
+				"Content-Type":   {"application/xml"},
+				"Ce-Specversion": {"1.0"},
+				"Ce-Source":      {"test"},
+			},
+			expectedBody: `<foo>bar</foo>`,
+			expectedRuntimeContext: map[string]string{
+				CeContextKey:     `{"datacontenttype":"application/xml","source":"test","specversion":"1.0"}`,
+				ClientContextKey: `{"custom":{"datacontenttype":"application/xml","source":"test","specversion":"1.0"}}`,
+			},
+		},
 		{
 			name:    "Event of other type",
 			request: `hello world`,
@@ -54,7 +120,7 @@ func TestCloudEvent_Request(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			ce := &CloudEvent{}
-			body, runtimeContext, err := ce.Request([]byte(tt.request), tt.headers)
+			body, runtimeContext, err := ce.Request([]byte(tt.request), &http.Request{Header: tt.headers})
 
 			if (err != nil) != tt.wantErr {
 				t.Errorf("Request() error = %v, wantErr %v", err, tt.wantErr)
@@ -71,3 +137,532 @@ func TestCloudEvent_Request(t *testing.T) {
 		})
 	}
 }
+
+func TestCloudEvent_Error(t *testing.T) {
+	ce := newCloudEvent(t, CloudEvent{
+		Overrides: Overrides{
+			Source:    "test",
+			ErrorType: "test.error",
+		},
+	})
+
+	resp, err := ce.Error(&converter.Error{
+		Type:       converter.ErrorTypeTimeout,
+		Message:    "Task timed out",
+		StatusCode: http.StatusGone,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusGone {
+		t.Errorf("Error() got status = %d, want %d", resp.StatusCode, http.StatusGone)
+	}
+
+	event := cloudevents.NewEvent()
+	if err := event.UnmarshalJSON(resp.Body); err != nil {
+		t.Fatal(err)
+	}
+	if event.Type() != "test.error" || event.Source() != "test" {
+		t.Errorf("Got %q type and %q source", event.Type(), event.Source())
+	}
+	if ext := event.Extensions()[errorTypeExtension]; ext != converter.ErrorTypeTimeout {
+		t.Errorf("Got %q error type extension, want %q", ext, converter.ErrorTypeTimeout)
+	}
+	if string(event.Data()) != `{"errorType":"Sandbox.Timedout","errorMessage":"Task timed out"}` {
+		t.Errorf("Got %s data", event.Data())
+	}
+}
+
+func TestCloudEvent_ErrorDataSchema(t *testing.T) {
+	schema := filepath.Join(t.TempDir(), "schema.json")
+	if err := ioutil.WriteFile(schema, []byte(`{"type":"object","required":["name"]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	dataSchema := "file://" + schema
+	context := map[string]string{
+		CeContextKey: `{"id":"request-1","source":"origin","dataschema":"` + dataSchema + `"}`,
+	}
+
+	ce := newCloudEvent(t, CloudEvent{
+		ContentMode:         ContentModeStructured,
+		ValidateOutbound:    true,
+		ValidateDataSchema:  true,
+		DataSchemaAllowlist: []string{"file://" + filepath.Dir(schema) + "/"},
+		Overrides: Overrides{
+			EventType: "test.type",
+			Source:    "test",
+			ErrorType: "test.error",
+		},
+	})
+
+	resp, err := ce.Error(&converter.Error{
+		Type:       converter.ErrorTypeUnhandled,
+		Message:    "boom",
+		StatusCode: http.StatusInternalServerError,
+	}, context)
+	if err != nil {
+		t.Fatalf("Error() got unexpected error: %v", err)
+	}
+	event := cloudevents.NewEvent()
+	if err := event.UnmarshalJSON(resp.Body); err != nil {
+		t.Fatal(err)
+	}
+	if event.DataSchema() != "" {
+		t.Errorf("Got %q error event dataschema, want none", event.DataSchema())
+	}
+
+	// response events still carry the inbound data schema
+	resp, err = ce.Response([]byte(`{"name":"foo"}`), context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := event.UnmarshalJSON(resp.Body); err != nil {
+		t.Fatal(err)
+	}
+	if event.DataSchema() != dataSchema {
+		t.Errorf("Got %q response event dataschema, want %q", event.DataSchema(), dataSchema)
+	}
+}
+
+func TestCloudEvent_ResponseBinary(t *testing.T) {
+	tests := []struct {
+		name            string
+		mode            string
+		response        string
+		expectedBody    string
+		expectedHeaders map[string]string
+	}{
+		{
+			name:         "Data response",
+			mode:         "data",
+			response:     `{"foo":"bar"}`,
+			expectedBody: `{"foo":"bar"}`,
+			expectedHeaders: map[string]string{
+				"Content-Type":   "application/json",
+				"Ce-Specversion": "1.0",
+				"Ce-Type":        "test.type",
+				"Ce-Source":      "test",
+			},
+		},
+		{
+			name:         "Event response",
+			mode:         "event",
+			response:     `{"type":"custom.type","subject":"foo","myext":"bar","datacontenttype":"text/plain","data":"hello"}`,
+			expectedBody: `hello`,
+			expectedHeaders: map[string]string{
+				"Content-Type": "text/plain",
+				"Ce-Type":      "custom.type",
+				"Ce-Source":    "test",
+				"Ce-Subject":   "foo",
+				"Ce-Myext":     "bar",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ce := newCloudEvent(t, CloudEvent{
+				FunctionResponseMode: tt.mode,
+				ContentMode:          ContentModeBinary,
+				Overrides: Overrides{
+					EventType: "test.type",
+					Source:    "test",
+				},
+			})
+			resp, err := ce.Response([]byte(tt.response), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(resp.Body) != tt.expectedBody {
+				t.Errorf("Response() got body = %s, want %s", resp.Body, tt.expectedBody)
+			}
+			for k, v := range tt.expectedHeaders {
+				if got := resp.Header.Get(k); got != v {
+					t.Errorf("Response() got %s header = %q, want %q", k, got, v)
+				}
+			}
+			if resp.Header.Get("Ce-Id") == "" || resp.Header.Get("Ce-Time") == "" {
+				t.Errorf("Response() id or time headers are missing: %v", resp.Header)
+			}
+		})
+	}
+}
+
+func TestCloudEvent_ResponseTemplates(t *testing.T) {
+	t.Setenv("K_SERVICE", "my-service")
+
+	ce := newCloudEvent(t, CloudEvent{
+		FunctionResponseMode: "data",
+		ContentMode:          ContentModeStructured,
+		Overrides: Overrides{
+			EventType: `{{ jsonpath "$.kind" .Data }}`,
+			Source:    `{{ env "K_SERVICE" }}`,
+			Subject:   `{{ .Request.subject }}`,
+			Extensions: map[string]string{
+				"requestsource": `{{ .Request.source }}`,
+				"missing":       `{{ .Data.missing }}`,
+			},
+		},
+	})
+
+	context := map[string]string{
+		CeContextKey: `{"source":"origin","subject":"order-42"}`,
+	}
+	resp, err := ce.Response([]byte(`{"kind":"order"}`), context)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := cloudevents.NewEvent()
+	if err := event.UnmarshalJSON(resp.Body); err != nil {
+		t.Fatal(err)
+	}
+	if event.Type() != "order" {
+		t.Errorf("Got %q type, want %q", event.Type(), "order")
+	}
+	if event.Source() != "my-service" {
+		t.Errorf("Got %q source, want %q", event.Source(), "my-service")
+	}
+	if event.Subject() != "order-42" {
+		t.Errorf("Got %q subject, want %q", event.Subject(), "order-42")
+	}
+	if ext := event.Extensions()["requestsource"]; ext != "origin" {
+		t.Errorf("Got %q requestsource extension, want %q", ext, "origin")
+	}
+	if _, set := event.Extensions()["missing"]; set {
+		t.Error("Empty extension must not be set")
+	}
+
+	if _, err := ce.Response([]byte(`{"foo":"bar"}`), context); err == nil {
+		t.Error("Response() expected error for the empty event type")
+	}
+}
+
+func TestCloudEvent_ResponseCorrelation(t *testing.T) {
+	context := map[string]string{
+		CeContextKey: `{"id":"request-1","source":"origin","correlationid":"chain-1",` +
+			`"traceparent":"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",` +
+			`"partitionkey":"p1","dataschema":"https://example.com/schema.json"}`,
+	}
+
+	tests := []struct {
+		name               string
+		mode               string
+		response           string
+		expectedDataSchema string
+	}{
+		{
+			name:               "Data response",
+			mode:               "data",
+			response:           `{"foo":"bar"}`,
+			expectedDataSchema: "https://example.com/schema.json",
+		},
+		{
+			name:               "Event response with own schema",
+			mode:               "event",
+			response:           `{"dataschema":"https://example.com/other.json","data":{"foo":"bar"}}`,
+			expectedDataSchema: "https://example.com/other.json",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ce := newCloudEvent(t, CloudEvent{
+				FunctionResponseMode: tt.mode,
+				ContentMode:          ContentModeStructured,
+				PropagateExtensions:  []string{"traceparent", "PartitionKey", "absent"},
+				Correlation:          true,
+				Overrides: Overrides{
+					EventType: "test.type",
+					Source:    "test",
+				},
+			})
+			resp, err := ce.Response([]byte(tt.response), context)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			event := cloudevents.NewEvent()
+			if err := event.UnmarshalJSON(resp.Body); err != nil {
+				t.Fatal(err)
+			}
+			expected := map[string]interface{}{
+				"traceparent":   "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+				"partitionkey":  "p1",
+				"causationid":   "request-1",
+				"correlationid": "chain-1",
+			}
+			if !reflect.DeepEqual(event.Extensions(), expected) {
+				t.Errorf("Got %v extensions, want %v", event.Extensions(), expected)
+			}
+			if event.DataSchema() != tt.expectedDataSchema {
+				t.Errorf("Got %q dataschema, want %q", event.DataSchema(), tt.expectedDataSchema)
+			}
+		})
+	}
+}
+
+func newCloudEvent(t *testing.T, ce CloudEvent) *CloudEvent {
+	templates, err := newTemplates(ce.Overrides)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ce.templates = templates
+	ce.schemas = newSchemas()
+	return &ce
+}
+
+func TestCloudEvent_SplitBatch(t *testing.T) {
+	batch := `[{"id":"1","source":"test","data":{"foo":"bar"}},` +
+		`{"id":"2","source":"test","datacontenttype":"text/plain","data":"hello"}]`
+	r := &http.Request{Header: http.Header{"Content-Type": {BatchContentType}}}
+
+	ce := newCloudEvent(t, CloudEvent{BatchMode: BatchModeSplit})
+	items, isBatch, err := ce.SplitBatch([]byte(batch), r)
+	if err != nil || !isBatch {
+		t.Fatalf("SplitBatch() got batch = %v, error = %v", isBatch, err)
+	}
+	if len(items) != 2 {
+		t.Fatalf("SplitBatch() got %d items, want 2", len(items))
+	}
+	if string(items[0].Data) != `{"foo":"bar"}` || string(items[1].Data) != `hello` {
+		t.Errorf("SplitBatch() got %s and %s data", items[0].Data, items[1].Data)
+	}
+	if items[1].Context[CeContextKey] != `{"datacontenttype":"text/plain","id":"2","source":"test"}` {
+		t.Errorf("SplitBatch() got %s context", items[1].Context[CeContextKey])
+	}
+
+	ce.BatchMode = BatchModeArray
+	items, _, err = ce.SplitBatch([]byte(batch), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 {
+		t.Fatalf("SplitBatch() got %d items, want 1", len(items))
+	}
+	if string(items[0].Data) != `[{"foo":"bar"},"hello"]` {
+		t.Errorf("SplitBatch() got %s data", items[0].Data)
+	}
+	if _, set := items[0].Context[BatchContextKey]; !set {
+		t.Errorf("SplitBatch() batch context key is missing")
+	}
+
+	if _, _, err := ce.SplitBatch([]byte(`[]`), r); err == nil {
+		t.Error("SplitBatch() got no error for the empty batch")
+	}
+
+	r.Header.Set("Content-Type", ContentType)
+	if _, isBatch, _ := ce.SplitBatch([]byte(batch), r); isBatch {
+		t.Error("SplitBatch() structured event is not a batch")
+	}
+}
+
+func TestCloudEvent_JoinBatch(t *testing.T) {
+	ce := newCloudEvent(t, CloudEvent{
+		FunctionResponseMode: "data",
+		ContentMode:          ContentModeBinary,
+		Overrides: Overrides{
+			EventType: "test.type",
+			Source:    "test",
+			ErrorType: "test.error",
+		},
+	})
+
+	success, err := ce.Response([]byte(`{"foo":"bar"}`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failure, err := ce.Error(&converter.Error{Type: "Unhandled", Message: "boom", StatusCode: http.StatusInternalServerError}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name               string
+		responses          []*converter.Response
+		expectedTypes      []string
+		expectedStatusCode int
+	}{
+		{
+			name:               "Partial failure",
+			responses:          []*converter.Response{failure, success, {}},
+			expectedTypes:      []string{"test.error", "test.type"},
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:               "All failed",
+			responses:          []*converter.Response{failure, failure},
+			expectedTypes:      []string{"test.error", "test.error"},
+			expectedStatusCode: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := ce.JoinBatch(tt.responses)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.expectedStatusCode {
+				t.Errorf("JoinBatch() got %d status, want %d", resp.StatusCode, tt.expectedStatusCode)
+			}
+			if ct := resp.Header.Get("Content-Type"); ct != BatchContentType {
+				t.Errorf("JoinBatch() got %q content type", ct)
+			}
+			var events []cloudevents.Event
+			if err := json.Unmarshal(resp.Body, &events); err != nil {
+				t.Fatal(err)
+			}
+			types := make([]string, len(events))
+			for i, event := range events {
+				types[i] = event.Type()
+			}
+			if !reflect.DeepEqual(types, tt.expectedTypes) {
+				t.Errorf("JoinBatch() got %v event types, want %v", types, tt.expectedTypes)
+			}
+		})
+	}
+}
+
+func TestCloudEvent_ResponseArrayBatch(t *testing.T) {
+	ce := newCloudEvent(t, CloudEvent{
+		FunctionResponseMode: "data",
+		ContentMode:          ContentModeStructured,
+		Overrides: Overrides{
+			EventType: "test.type",
+			Source:    "test",
+			Subject:   "{{ .Request.id }}",
+		},
+	})
+
+	context, err := newRuntimeContext([]map[string]string{{"id": "1"}, {"id": "2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	context[BatchContextKey] = "true"
+
+	resp, err := ce.Response([]byte(`[{"n":1},{"n":2}]`), context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []cloudevents.Event
+	if err := json.Unmarshal(resp.Body, &events); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].Subject() != "1" || events[1].Subject() != "2" {
+		t.Errorf("Response() got %s batch", resp.Body)
+	}
+}
+
+func TestCloudEvent_ResponseMultipleEvents(t *testing.T) {
+	ce := newCloudEvent(t, CloudEvent{
+		FunctionResponseMode: "event",
+		ContentMode:          ContentModeBinary,
+		Overrides: Overrides{
+			EventType: "test.type",
+			Source:    "test",
+		},
+	})
+
+	resp, err := ce.Response([]byte(`[{"data":{"n":1}},{"type":"custom.type","data":{"n":2}}]`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != BatchContentType {
+		t.Errorf("Response() got %q content type, want %q", ct, BatchContentType)
+	}
+	var events []cloudevents.Event
+	if err := json.Unmarshal(resp.Body, &events); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].Type() != "test.type" || events[1].Type() != "custom.type" {
+		t.Fatalf("Response() got %s batch", resp.Body)
+	}
+	if events[0].ID() == "" || events[0].ID() == events[1].ID() {
+		t.Errorf("Got %q and %q event IDs", events[0].ID(), events[1].ID())
+	}
+	if len(resp.Parts) != 2 || resp.Parts[1].Header.Get("ce-type") != "custom.type" {
+		t.Errorf("Got %d batch parts, want 2 binary events", len(resp.Parts))
+	}
+
+	if _, err := ce.Response([]byte(`[{"data":1},"foo"]`), nil); err == nil {
+		t.Error("Response() expected error for the invalid event")
+	}
+}
+
+func TestCloudEvent_Validation(t *testing.T) {
+	schema := filepath.Join(t.TempDir(), "schema.json")
+	if err := ioutil.WriteFile(schema, []byte(`{"type":"object","required":["name"]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ce := newCloudEvent(t, CloudEvent{
+		FunctionResponseMode: "event",
+		ContentMode:          ContentModeStructured,
+		ValidateInbound:      true,
+		ValidateOutbound:     true,
+		Schemas:              map[string]string{"test.type": schema},
+		Overrides: Overrides{
+			EventType: "test.response",
+			Source:    "test",
+		},
+	})
+
+	requests := []struct {
+		name    string
+		body    string
+		header  http.Header
+		wantErr bool
+	}{
+		{
+			name:   "Valid event",
+			body:   `{"specversion":"1.0","id":"1","type":"test.type","source":"test","data":{"name":"foo"}}`,
+			header: http.Header{"Content-Type": {ContentType}},
+		},
+		{
+			name:    "Missing source",
+			body:    `{"specversion":"1.0","id":"1","type":"test.type","data":{"name":"foo"}}`,
+			header:  http.Header{"Content-Type": {ContentType}},
+			wantErr: true,
+		},
+		{
+			name:    "Unsupported specversion",
+			body:    `{"specversion":"0.2","id":"1","type":"other.type","source":"test"}`,
+			header:  http.Header{"Content-Type": {ContentType}},
+			wantErr: true,
+		},
+		{
+			name:    "Data does not match schema",
+			body:    `{"specversion":"1.0","id":"1","type":"test.type","source":"test","data":{"foo":"bar"}}`,
+			header:  http.Header{"Content-Type": {ContentType}},
+			wantErr: true,
+		},
+		{
+			name:    "Not an event",
+			body:    `foo`,
+			header:  http.Header{"Content-Type": {"text/plain"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range requests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := ce.Request([]byte(tt.body), &http.Request{Header: tt.header})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Request() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var invalid *converter.InvalidEventError
+			if tt.wantErr && (!errors.As(err, &invalid) || string(invalid.Event.Body) != tt.body) {
+				t.Errorf("Request() got %v error, want rejected event", err)
+			}
+		})
+	}
+
+	if _, err := ce.Response([]byte(`{"type":"test.type","data":{"name":"foo"}}`), nil); err != nil {
+		t.Errorf("Response() got unexpected error: %v", err)
+	}
+	_, err := ce.Response([]byte(`[{"type":"test.type","data":{"name":"foo"}},{"type":"test.type","data":{}}]`), nil)
+	var invalid *converter.InvalidEventError
+	if !errors.As(err, &invalid) {
+		t.Errorf("Response() got %v error, want rejected event", err)
+	}
+}
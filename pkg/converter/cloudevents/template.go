@@ -0,0 +1,142 @@
+/*
+Copyright 2023 Triggermesh Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloudevents
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+
+	"github.com/triggermesh/aws-custom-runtime/pkg/jsonpath"
+)
+
+// Placeholder printed by text/template for the missing map keys.
+const noValue = "<no value>"
+
+// templateData is passed to the response attribute templates.
+type templateData struct {
+	// Request contains inbound event context attributes.
+	Request map[string]string
+	// Data is the function response, decoded if it is a JSON.
+	Data interface{}
+}
+
+// attributes are the response event attributes rendered for the invocation.
+type attributes struct {
+	eventType  string
+	source     string
+	subject    string
+	dataSchema string
+	extensions map[string]string
+}
+
+// templates holds parsed response event attribute templates.
+type templates struct {
+	eventType  *template.Template
+	errorType  *template.Template
+	source     *template.Template
+	subject    *template.Template
+	extensions map[string]*template.Template
+}
+
+func newTemplates(o Overrides) (*templates, error) {
+	var t templates
+	var err error
+	if t.eventType, err = parseTemplate("type", o.EventType); err != nil {
+		return nil, err
+	}
+	if t.errorType, err = parseTemplate("error_type", o.ErrorType); err != nil {
+		return nil, err
+	}
+	if t.source, err = parseTemplate("source", o.Source); err != nil {
+		return nil, err
+	}
+	if t.subject, err = parseTemplate("subject", o.Subject); err != nil {
+		return nil, err
+	}
+	t.extensions = make(map[string]*template.Template, len(o.Extensions))
+	for name, text := range o.Extensions {
+		if t.extensions[name], err = parseTemplate(name, text); err != nil {
+			return nil, err
+		}
+	}
+	return &t, nil
+}
+
+func parseTemplate(name, text string) (*template.Template, error) {
+	t, err := template.New(name).
+		Option("missingkey=zero").
+		Funcs(template.FuncMap{
+			"env":      os.Getenv,
+			"jsonpath": jsonpath.Get,
+		}).
+		Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse %q attribute template: %w", name, err)
+	}
+	return t, nil
+}
+
+// render returns response event attributes for the given event type template.
+func (t *templates) render(eventType *template.Template, request map[string]string, data []byte) (*attributes, error) {
+	td := templateData{
+		Request: request,
+		Data:    string(data),
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(data, &decoded); err == nil {
+		td.Data = decoded
+	}
+
+	var a attributes
+	var err error
+	if a.eventType, err = execute(eventType, td); err != nil {
+		return nil, err
+	}
+	if a.source, err = execute(t.source, td); err != nil {
+		return nil, err
+	}
+	if a.subject, err = execute(t.subject, td); err != nil {
+		return nil, err
+	}
+	a.extensions = make(map[string]string, len(t.extensions))
+	for name, ext := range t.extensions {
+		if a.extensions[name], err = execute(ext, td); err != nil {
+			return nil, err
+		}
+	}
+	return &a, nil
+}
+
+func execute(t *template.Template, data templateData) (string, error) {
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("cannot render %q attribute: %w", t.Name(), err)
+	}
+	return strings.TrimSpace(strings.ReplaceAll(b.String(), noValue, "")), nil
+}
+
+// requestAttributes reads the inbound event attributes from the invocation context.
+func requestAttributes(context map[string]string) map[string]string {
+	attributes := make(map[string]string)
+	if ceContext, exists := context[CeContextKey]; exists {
+		_ = json.Unmarshal([]byte(ceContext), &attributes)
+	}
+	return attributes
+}
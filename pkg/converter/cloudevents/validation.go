@@ -0,0 +1,230 @@
+/*
+Copyright 2023 Triggermesh Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloudevents
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	// enables http and https schema locations
+	_ "github.com/santhosh-tekuri/jsonschema/v5/httploader"
+
+	"github.com/triggermesh/aws-custom-runtime/pkg/converter"
+)
+
+// requiredAttributes must be set in every event.
+var requiredAttributes = []string{"id", "source", "specversion", "type"}
+
+const (
+	// maxSchemas limits the number of cached schemas. Schemas referenced by
+	// the events are dropped to make room for the new ones, the configured
+	// schemas are always kept.
+	maxSchemas = 100
+	// failedSchemaTTL is the time the schema that could not be loaded
+	// is not fetched again.
+	failedSchemaTTL = time.Minute
+)
+
+// schemas caches compiled JSON Schemas by their location. Each location
+// is loaded once, concurrent lookups wait for the same compilation.
+type schemas struct {
+	mu      sync.Mutex
+	entries map[string]*schemaEntry
+}
+
+type schemaEntry struct {
+	// ready is closed when the compilation is over
+	ready      chan struct{}
+	schema     *jsonschema.Schema
+	err        error
+	failed     time.Time
+	configured bool
+}
+
+func newSchemas() *schemas {
+	return &schemas{
+		entries: make(map[string]*schemaEntry),
+	}
+}
+
+// get returns the compiled schema. Configured schemas are never dropped from the cache.
+func (s *schemas) get(location string, configured bool) (*jsonschema.Schema, error) {
+	s.mu.Lock()
+	e, exists := s.entries[location]
+	if exists && e.expired(time.Now()) {
+		exists = false
+	}
+	if !exists {
+		s.evict()
+		e = &schemaEntry{
+			ready:      make(chan struct{}),
+			configured: configured,
+		}
+		s.entries[location] = e
+	}
+	s.mu.Unlock()
+
+	if exists {
+		<-e.ready
+		return e.schema, e.err
+	}
+	defer close(e.ready)
+	if e.schema, e.err = jsonschema.Compile(location); e.err != nil {
+		e.err = fmt.Errorf("cannot load JSON Schema %q: %w", location, e.err)
+		e.failed = time.Now()
+	}
+	return e.schema, e.err
+}
+
+// evict drops one of the loaded schemas referenced by the events
+// if the cache is full.
+func (s *schemas) evict() {
+	if len(s.entries) < maxSchemas {
+		return
+	}
+	for location, e := range s.entries {
+		if !e.configured && e.done() {
+			delete(s.entries, location)
+			return
+		}
+	}
+}
+
+func (e *schemaEntry) done() bool {
+	select {
+	case <-e.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// expired reports whether the schema failed to load long enough ago to be fetched again.
+func (e *schemaEntry) expired(now time.Time) bool {
+	return e.done() && e.err != nil && now.Sub(e.failed) > failedSchemaTTL
+}
+
+// allowedDataSchema reports whether the schema referenced by the dataschema
+// attribute of the event may be loaded: it must be one of the configured
+// schemas or start with one of the allowed location prefixes.
+func (ce *CloudEvent) allowedDataSchema(location string) bool {
+	for _, configured := range ce.Schemas {
+		if location == configured {
+			return true
+		}
+	}
+	u, err := url.Parse(location)
+	if err != nil || !u.IsAbs() || u.User != nil || strings.Contains(u.Path+"/", "/../") {
+		return false
+	}
+	for _, prefix := range ce.DataSchemaAllowlist {
+		if prefix != "" && strings.HasPrefix(location, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateRequest checks the inbound event attributes and data.
+func (ce *CloudEvent) validateRequest(attrs map[string]string, data []byte) error {
+	for _, name := range requiredAttributes {
+		if attrs[name] == "" {
+			return fmt.Errorf("required attribute %q is missing", name)
+		}
+	}
+	if version := attrs["specversion"]; version != cloudevents.VersionV1 {
+		return fmt.Errorf("unsupported specversion %q", version)
+	}
+	return ce.validateData(attrs["type"], attrs["dataschema"], data)
+}
+
+// validateResponse checks the response event or every event of the batch.
+func (ce *CloudEvent) validateResponse(resp *converter.Response) error {
+	if len(resp.Parts) != 0 {
+		for _, part := range resp.Parts {
+			if err := ce.validateResponse(part); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if len(resp.Body) == 0 && len(resp.Header) == 0 {
+		return nil
+	}
+
+	data, err := structured(resp)
+	if err != nil {
+		return err
+	}
+	event := cloudevents.NewEvent()
+	if err := event.UnmarshalJSON(data); err != nil {
+		return err
+	}
+	if err := event.Validate(); err != nil {
+		return err
+	}
+	return ce.validateData(event.Type(), event.DataSchema(), event.Data())
+}
+
+// validateData checks the event data against the JSON Schema configured for
+// the event type or, if enabled, referenced by the dataschema attribute.
+func (ce *CloudEvent) validateData(eventType, dataSchema string, data []byte) error {
+	location, configured := ce.Schemas[eventType]
+	if !configured && ce.ValidateDataSchema && dataSchema != "" {
+		if !ce.allowedDataSchema(dataSchema) {
+			return fmt.Errorf("dataschema %q is not allowed", dataSchema)
+		}
+		location = dataSchema
+	}
+	if location == "" {
+		return nil
+	}
+	schema, err := ce.schemas.get(location, configured)
+	if err != nil {
+		return err
+	}
+
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return fmt.Errorf("event data is not a valid JSON: %w", err)
+	}
+	if err := schema.Validate(value); err != nil {
+		return fmt.Errorf("event data does not match the schema: %w", err)
+	}
+	return nil
+}
+
+// invalidRequest wraps the validation error of the inbound event.
+func invalidRequest(request []byte, header http.Header, err error) error {
+	return &converter.InvalidEventError{
+		Event: &converter.Response{
+			Body:   request,
+			Header: header.Clone(),
+		},
+		Err: err,
+	}
+}
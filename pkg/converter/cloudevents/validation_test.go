@@ -0,0 +1,138 @@
+package cloudevents
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCloudEvent_AllowedDataSchema(t *testing.T) {
+	ce := &CloudEvent{
+		Schemas:             map[string]string{"test.type": "/schemas/order.json"},
+		DataSchemaAllowlist: []string{"https://schemas.example.com/"},
+	}
+
+	tests := []struct {
+		location string
+		expected bool
+	}{
+		{location: "/schemas/order.json", expected: true},
+		{location: "https://schemas.example.com/order.json", expected: true},
+		{location: "https://schemas.example.com.evil.com/order.json", expected: false},
+		{location: "https://schemas.example.com/../order.json", expected: false},
+		{location: "https://schemas.example.com/%2e%2e/order.json", expected: false},
+		{location: "https://user@schemas.example.com/order.json", expected: false},
+		{location: "http://169.254.169.254/latest/meta-data", expected: false},
+		{location: "file:///etc/passwd", expected: false},
+		{location: "/etc/passwd", expected: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.location, func(t *testing.T) {
+			if allowed := ce.allowedDataSchema(tt.location); allowed != tt.expected {
+				t.Errorf("Got %v for %q, want %v", allowed, tt.location, tt.expected)
+			}
+		})
+	}
+
+	ce.DataSchemaAllowlist = nil
+	if ce.allowedDataSchema("https://schemas.example.com/order.json") {
+		t.Error("Location is allowed with empty allowlist")
+	}
+}
+
+func TestCloudEvent_DataSchemaNotAllowed(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Write([]byte(`{"type":"object"}`))
+	}))
+	defer server.Close()
+
+	ce := newCloudEvent(t, CloudEvent{ValidateDataSchema: true})
+	if err := ce.validateData("test.type", server.URL+"/schema.json", []byte(`{}`)); err == nil {
+		t.Error("validateData() got no error for the dataschema that is not allowed")
+	}
+	if n := atomic.LoadInt32(&requests); n != 0 {
+		t.Errorf("Got %d schema requests, want none", n)
+	}
+}
+
+func TestSchemas(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.URL.Path == "/missing.json" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"type":"object"}`))
+	}))
+	defer server.Close()
+
+	s := newSchemas()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s.get(server.URL+"/schema.json", false); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("Got %d requests of the concurrently loaded schema, want 1", n)
+	}
+
+	// failures are cached
+	for i := 0; i < 2; i++ {
+		if _, err := s.get(server.URL+"/missing.json", false); err == nil {
+			t.Error("get() got no error for the missing schema")
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("Got %d requests after the failed schema, want 2", n)
+	}
+	s.entries[server.URL+"/missing.json"].failed = s.entries[server.URL+"/missing.json"].failed.Add(-2 * failedSchemaTTL)
+	if _, err := s.get(server.URL+"/missing.json", false); err == nil {
+		t.Error("get() got no error for the missing schema")
+	}
+	if n := atomic.LoadInt32(&requests); n != 3 {
+		t.Errorf("Got %d requests after the failure expired, want 3", n)
+	}
+}
+
+func TestSchemasLimit(t *testing.T) {
+	dir := t.TempDir()
+	configured := filepath.Join(dir, "configured.json")
+	if err := ioutil.WriteFile(configured, []byte(`{"type":"object"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newSchemas()
+	if _, err := s.get(configured, true); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2*maxSchemas; i++ {
+		location := filepath.Join(dir, fmt.Sprintf("%d.json", i))
+		if err := ioutil.WriteFile(location, []byte(`{"type":"object"}`), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.get(location, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(s.entries) > maxSchemas {
+		t.Errorf("Got %d cached schemas, want at most %d", len(s.entries), maxSchemas)
+	}
+	if _, exists := s.entries[configured]; !exists {
+		t.Error("Configured schema is dropped from the cache")
+	}
+}
@@ -17,23 +17,159 @@ limitations under the License.
 package converter
 
 import (
+	"fmt"
 	"net/http"
-
-	"github.com/triggermesh/aws-custom-runtime/pkg/converter/cloudevents"
-	"github.com/triggermesh/aws-custom-runtime/pkg/converter/plain"
+	"sort"
+	"strings"
+	"sync"
 )
 
+// DefaultFormat is used when the format is not set.
+const DefaultFormat = "PLAIN"
+
+// RequestConverter turns incoming requests into the function payload
+// and the invocation context.
+type RequestConverter interface {
+	Request([]byte, *http.Request) ([]byte, map[string]string, error)
+}
+
+// ResponseConverter wraps function responses and errors into the output format.
+// Context is the invocation context returned by the RequestConverter.
+type ResponseConverter interface {
+	Response(data []byte, context map[string]string) (*Response, error)
+	Error(e *Error, context map[string]string) (*Response, error)
+}
+
+// Response is the function response or error rendered in the output format.
+type Response struct {
+	Body   []byte
+	Header http.Header
+	// StatusCode overrides the function status code if set.
+	StatusCode int
+	// Parts are the separate messages of the batched response
+	// that are delivered one by one to the sink.
+	Parts []*Response
+}
+
+// NewResponse returns the response with the content type header.
+func NewResponse(body []byte, contentType string) *Response {
+	header := make(http.Header)
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	return &Response{
+		Body:   body,
+		Header: header,
+	}
+}
+
+// Converter handles both directions of the invocation.
 type Converter interface {
-	Response([]byte) ([]byte, error)
-	Request([]byte, http.Header) ([]byte, map[string]string, error)
-	ContentType() string
+	RequestConverter
+	ResponseConverter
+}
+
+// Item is a single invocation of the batched request.
+type Item struct {
+	Data    []byte
+	Context map[string]string
+}
+
+// BatchConverter is implemented by the converters that accept
+// multiple events in one request.
+type BatchConverter interface {
+	// SplitBatch converts the batched request into invocations,
+	// it returns false if the request is not a batch.
+	SplitBatch([]byte, *http.Request) ([]Item, bool, error)
+	// JoinBatch aggregates the invocation responses into one response.
+	JoinBatch([]*Response) (*Response, error)
 }
 
+// Pair composes a Converter from the request and response converters
+// of different formats.
+type Pair struct {
+	RequestConverter
+	ResponseConverter
+}
+
+var _ BatchConverter = Pair{}
+
+// SplitBatch splits the batched request with the request converter. Requests
+// split into multiple invocations are rejected if the response converter
+// cannot join their responses.
+func (p Pair) SplitBatch(request []byte, r *http.Request) ([]Item, bool, error) {
+	batch, ok := p.RequestConverter.(BatchConverter)
+	if !ok {
+		return nil, false, nil
+	}
+	items, isBatch, err := batch.SplitBatch(request, r)
+	if err != nil || !isBatch {
+		return items, isBatch, err
+	}
+	if _, ok := p.ResponseConverter.(BatchConverter); !ok && len(items) > 1 {
+		return nil, true, fmt.Errorf("response format does not support batches of %d invocations", len(items))
+	}
+	return items, true, nil
+}
+
+// JoinBatch aggregates the responses with the response converter.
+// Single invocation response is returned as is.
+func (p Pair) JoinBatch(responses []*Response) (*Response, error) {
+	if batch, ok := p.ResponseConverter.(BatchConverter); ok {
+		return batch.JoinBatch(responses)
+	}
+	if len(responses) != 1 {
+		return nil, fmt.Errorf("response format does not support batches of %d invocations", len(responses))
+	}
+	return responses[0], nil
+}
+
+// Factory creates new Converter instance.
+type Factory func() (Converter, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]Factory)
+)
+
+// Register makes a converter available by the provided format name.
+// Converter packages are expected to call it from their init functions.
+func Register(format string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	format = strings.ToUpper(format)
+	if _, exists := registry[format]; exists {
+		panic(fmt.Sprintf("converter %q is already registered", format))
+	}
+	registry[format] = factory
+}
+
+// Formats returns the sorted list of registered format names.
+func Formats() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	formats := make([]string, 0, len(registry))
+	for format := range registry {
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+	return formats
+}
+
+// New creates the converter registered with the format name.
 func New(format string) (Converter, error) {
-	switch format {
-	case "API_GATEWAY":
-	case "CLOUDEVENTS":
-		return cloudevents.New()
+	if format == "" {
+		format = DefaultFormat
+	}
+	format = strings.ToUpper(format)
+
+	registryMu.RLock()
+	factory, exists := registry[format]
+	registryMu.RUnlock()
+	if !exists {
+		return nil, fmt.Errorf("unknown format %q, supported formats: %s", format, strings.Join(Formats(), ", "))
 	}
-	return plain.New()
+	return factory()
 }
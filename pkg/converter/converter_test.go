@@ -0,0 +1,235 @@
+package converter
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+type fake struct {
+	format string
+}
+
+func (f *fake) Response(data []byte, _ map[string]string) (*Response, error) {
+	return NewResponse(data, f.format), nil
+}
+
+func (f *fake) Error(e *Error, _ map[string]string) (*Response, error) {
+	return NewResponse(e.JSON(), f.format), nil
+}
+
+func (f *fake) Request(data []byte, _ *http.Request) ([]byte, map[string]string, error) {
+	return data, map[string]string{"format": f.format}, nil
+}
+
+// responseFormat returns the name of the format that renders responses.
+func responseFormat(c ResponseConverter) string {
+	resp, _ := c.Response(nil, nil)
+	return resp.Header.Get("Content-Type")
+}
+
+func init() {
+	for _, format := range []string{DefaultFormat, "FOO", "BAR"} {
+		format := format
+		Register(format, func() (Converter, error) {
+			return &fake{format: format}, nil
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		format   string
+		expected string
+		wantErr  bool
+	}{
+		{format: "", expected: DefaultFormat},
+		{format: "foo", expected: "FOO"},
+		{format: "UNKNOWN", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			c, err := New(tt.format)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("New() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				return
+			}
+			if got := responseFormat(c); got != tt.expected {
+				t.Errorf("New() got = %v, want %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestRouterSelect(t *testing.T) {
+	r, err := NewRouter("", "",
+		map[string]string{"/foo": "FOO", "/foo/bar": "BAR"},
+		map[string]string{"application/cloudevents": "BAR"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		path        string
+		contentType string
+		expected    string
+	}{
+		{name: "Path prefix", path: "/foo/baz", expected: "FOO"},
+		{name: "Longest path prefix", path: "/foo/bar/baz", expected: "BAR"},
+		{name: "Path before content type", path: "/foo", contentType: "application/cloudevents+json", expected: "FOO"},
+		{name: "Content type", path: "/", contentType: "application/cloudevents+json", expected: "BAR"},
+		{name: "Default", path: "/", contentType: "application/json", expected: DefaultFormat},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, tt.path, nil)
+			req.Header.Set("Content-Type", tt.contentType)
+			if got := responseFormat(r.Select(req)); got != tt.expected {
+				t.Errorf("Select() got = %v, want %v", got, tt.expected)
+			}
+		})
+	}
+
+	if _, err := NewRouter("", "", map[string]string{"/foo": "BAZ"}, nil); err == nil {
+		t.Error("NewRouter() expected error for unknown format")
+	}
+}
+
+func TestRouterPair(t *testing.T) {
+	tests := []struct {
+		name             string
+		requestFormat    string
+		responseFormat   string
+		paths            map[string]string
+		expectedRequest  string
+		expectedResponse string
+	}{
+		{name: "Same formats", responseFormat: "FOO", expectedRequest: "FOO", expectedResponse: "FOO"},
+		{name: "Default response", requestFormat: "FOO", expectedRequest: "FOO", expectedResponse: DefaultFormat},
+		{name: "Separate formats", requestFormat: "FOO", responseFormat: "BAR", expectedRequest: "FOO", expectedResponse: "BAR"},
+		{name: "Separate formats in rule", paths: map[string]string{"/": "BAR>FOO"}, expectedRequest: "BAR", expectedResponse: "FOO"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewRouter(tt.requestFormat, tt.responseFormat, tt.paths, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := r.Select(httptest.NewRequest(http.MethodPost, "/", nil))
+			if _, context, _ := c.Request(nil, nil); context["format"] != tt.expectedRequest {
+				t.Errorf("Request() got = %v, want %v", context["format"], tt.expectedRequest)
+			}
+			if got := responseFormat(c); got != tt.expectedResponse {
+				t.Errorf("Response() got = %v, want %v", got, tt.expectedResponse)
+			}
+		})
+	}
+}
+
+// batchFake splits the request lines into separate invocations
+// and joins the responses with new lines.
+type batchFake struct {
+	fake
+}
+
+func (f *batchFake) SplitBatch(data []byte, _ *http.Request) ([]Item, bool, error) {
+	lines := bytes.Split(data, []byte("\n"))
+	if len(lines) < 2 {
+		return nil, false, nil
+	}
+	items := make([]Item, len(lines))
+	for i, line := range lines {
+		items[i].Data = line
+	}
+	return items, true, nil
+}
+
+func (f *batchFake) JoinBatch(responses []*Response) (*Response, error) {
+	bodies := make([][]byte, len(responses))
+	for i, resp := range responses {
+		bodies[i] = resp.Body
+	}
+	return NewResponse(bytes.Join(bodies, []byte("\n")), f.format), nil
+}
+
+func TestPairBatch(t *testing.T) {
+	batch := &batchFake{fake{format: "BATCH"}}
+	responses := []*Response{{Body: []byte("a")}, {Body: []byte("b")}}
+
+	pair := Pair{RequestConverter: batch, ResponseConverter: batch}
+	items, isBatch, err := pair.SplitBatch([]byte("a\nb"), nil)
+	if err != nil || !isBatch || len(items) != 2 {
+		t.Errorf("SplitBatch() got %d items, %v, %v, want 2 items of the batch", len(items), isBatch, err)
+	}
+	if resp, err := pair.JoinBatch(responses); err != nil || string(resp.Body) != "a\nb" {
+		t.Errorf("JoinBatch() got %v, %v, want joined responses", resp, err)
+	}
+
+	// responses of the non-batch format cannot be joined
+	pair = Pair{RequestConverter: batch, ResponseConverter: &fake{format: "FOO"}}
+	if _, isBatch, err := pair.SplitBatch([]byte("a\nb"), nil); !isBatch || err == nil {
+		t.Errorf("SplitBatch() got %v, %v, want rejected batch", isBatch, err)
+	}
+	if _, isBatch, err := pair.SplitBatch([]byte("a"), nil); isBatch || err != nil {
+		t.Errorf("SplitBatch() got %v, %v, want single request", isBatch, err)
+	}
+	if resp, err := pair.JoinBatch(responses[:1]); err != nil || string(resp.Body) != "a" {
+		t.Errorf("JoinBatch() got %v, %v, want single response", resp, err)
+	}
+
+	// request format without batches
+	pair = Pair{RequestConverter: &fake{format: "FOO"}, ResponseConverter: batch}
+	if _, isBatch, _ := pair.SplitBatch([]byte("a\nb"), nil); isBatch {
+		t.Error("SplitBatch() got batch of the non-batch request format")
+	}
+}
+
+func TestParseError(t *testing.T) {
+	tests := []struct {
+		name       string
+		data       string
+		statusCode int
+		expected   Error
+	}{
+		{
+			name:       "Lambda error",
+			data:       `{"errorType":"ValueError","errorMessage":"boom","stackTrace":["line 1"]}`,
+			statusCode: http.StatusInternalServerError,
+			expected:   Error{Type: "ValueError", Message: "boom", StackTrace: []string{"line 1"}, StatusCode: http.StatusInternalServerError},
+		},
+		{
+			name:       "Error without type",
+			data:       `{"errorMessage":"boom"}`,
+			statusCode: http.StatusInternalServerError,
+			expected:   Error{Type: ErrorTypeUnhandled, Message: "boom", StatusCode: http.StatusInternalServerError},
+		},
+		{
+			name:     "Raw error",
+			data:     `something went wrong`,
+			expected: Error{Type: ErrorTypeUnhandled, Message: "something went wrong", StatusCode: http.StatusInternalServerError},
+		},
+		{
+			name:     "Unrelated JSON",
+			data:     `{"foo":"bar"}`,
+			expected: Error{Type: ErrorTypeUnhandled, Message: `{"foo":"bar"}`, StatusCode: http.StatusInternalServerError},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ParseError([]byte(tt.data), tt.statusCode); !reflect.DeepEqual(*got, tt.expected) {
+				t.Errorf("ParseError() got = %+v, want %+v", *got, tt.expected)
+			}
+		})
+	}
+}
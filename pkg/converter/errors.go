@@ -0,0 +1,99 @@
+/*
+Copyright 2023 Triggermesh Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package converter
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Error types reported by the runtime.
+const (
+	ErrorTypeRequestTooLarge = "Runtime.RequestTooLarge"
+	ErrorTypeInvalidRequest  = "Runtime.InvalidRequest"
+	ErrorTypeInvalidResponse = "Runtime.InvalidResponse"
+	ErrorTypeInvalidEvent    = "Runtime.InvalidEvent"
+	ErrorTypeUnavailable     = "Runtime.Unavailable"
+	ErrorTypeTimeout         = "Sandbox.Timedout"
+	// ErrorTypeUnhandled is used for function errors without type.
+	ErrorTypeUnhandled = "Unhandled"
+)
+
+// Error is the Lambda-compatible error model for both runtime
+// and function errors.
+type Error struct {
+	Type       string   `json:"errorType"`
+	Message    string   `json:"errorMessage"`
+	StackTrace []string `json:"stackTrace,omitempty"`
+
+	// StatusCode is the HTTP status of the error response.
+	StatusCode int `json:"-"`
+}
+
+// NewError creates the runtime error of the given type.
+func NewError(errorType string, statusCode int, format string, a ...interface{}) *Error {
+	return &Error{
+		Type:       errorType,
+		Message:    fmt.Sprintf(format, a...),
+		StatusCode: statusCode,
+	}
+}
+
+// ParseError reads the error reported by the function. Errors
+// that are not in the Lambda format are wrapped as unhandled.
+func ParseError(data []byte, statusCode int) *Error {
+	e := Error{
+		StatusCode: statusCode,
+	}
+	if err := json.Unmarshal(data, &e); err != nil || (e.Type == "" && e.Message == "") {
+		e.Message = string(data)
+	}
+	if e.Type == "" {
+		e.Type = ErrorTypeUnhandled
+	}
+	if e.StatusCode == 0 {
+		e.StatusCode = http.StatusInternalServerError
+	}
+	return &e
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Type, e.Message)
+}
+
+// JSON returns the Lambda error representation.
+func (e *Error) JSON() []byte {
+	data, _ := json.Marshal(e)
+	return data
+}
+
+// InvalidEventError is returned by the converters for the inbound
+// or outbound events that failed validation.
+type InvalidEventError struct {
+	// Event is the rejected event message.
+	Event *Response
+	Err   error
+}
+
+func (e *InvalidEventError) Error() string {
+	return fmt.Sprintf("invalid event: %v", e.Err)
+}
+
+func (e *InvalidEventError) Unwrap() error {
+	return e.Err
+}
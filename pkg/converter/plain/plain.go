@@ -16,24 +16,42 @@ limitations under the License.
 
 package plain
 
-import "net/http"
+import (
+	"net/http"
+
+	"github.com/triggermesh/aws-custom-runtime/pkg/converter"
+)
 
 type Plain struct{}
 
-const contentType = "plain/text"
+const (
+	// Format is the converter name in the runtime configuration.
+	Format = "PLAIN"
+
+	contentType = "plain/text"
+)
+
+func init() {
+	converter.Register(Format, func() (converter.Converter, error) {
+		return New()
+	})
+}
 
 func New() (*Plain, error) {
 	return &Plain{}, nil
 }
 
-func (p *Plain) Response(data []byte) ([]byte, error) {
-	return data, nil
+func (p *Plain) Response(data []byte, _ map[string]string) (*converter.Response, error) {
+	return converter.NewResponse(data, contentType), nil
 }
 
-func (p *Plain) Request(request []byte, headers http.Header) ([]byte, map[string]string, error) {
-	return request, nil, nil
+// Error returns Lambda error JSON.
+func (p *Plain) Error(e *converter.Error, _ map[string]string) (*converter.Response, error) {
+	resp := converter.NewResponse(e.JSON(), contentType)
+	resp.StatusCode = e.StatusCode
+	return resp, nil
 }
 
-func (p *Plain) ContentType() string {
-	return contentType
+func (p *Plain) Request(request []byte, _ *http.Request) ([]byte, map[string]string, error) {
+	return request, nil, nil
 }
@@ -0,0 +1,141 @@
+/*
+Copyright 2023 Triggermesh Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package converter
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// formatSeparator splits request and response formats in the routing rules,
+// e.g. "CLOUDEVENTS>API_GATEWAY".
+const formatSeparator = ">"
+
+// Router selects the converter for each incoming request
+// by its path prefix or content type.
+type Router struct {
+	fallback     Converter
+	paths        []route
+	contentTypes []route
+
+	instances map[string]Converter
+}
+
+type route struct {
+	prefix    string
+	converter Converter
+}
+
+// NewRouter creates converters for the default request and response formats
+// and for every format referenced in path prefix and content type rules.
+// Rules are maps of path or content type prefixes to the format names. Rule may
+// set a single format for both directions or separate request and response
+// formats joined with ">". Empty request format defaults to the response format.
+func NewRouter(requestFormat, responseFormat string, paths, contentTypes map[string]string) (*Router, error) {
+	r := &Router{
+		instances: make(map[string]Converter),
+	}
+
+	if requestFormat == "" {
+		requestFormat = responseFormat
+	}
+	var err error
+	if r.fallback, err = r.pair(requestFormat, responseFormat); err != nil {
+		return nil, err
+	}
+	if r.paths, err = r.routes(paths); err != nil {
+		return nil, fmt.Errorf("path rules: %w", err)
+	}
+	if r.contentTypes, err = r.routes(contentTypes); err != nil {
+		return nil, fmt.Errorf("content type rules: %w", err)
+	}
+	return r, nil
+}
+
+func (r *Router) instance(format string) (Converter, error) {
+	if format == "" {
+		format = DefaultFormat
+	}
+	format = strings.ToUpper(strings.TrimSpace(format))
+	if c, exists := r.instances[format]; exists {
+		return c, nil
+	}
+	c, err := New(format)
+	if err != nil {
+		return nil, err
+	}
+	r.instances[format] = c
+	return c, nil
+}
+
+func (r *Router) pair(requestFormat, responseFormat string) (Converter, error) {
+	req, err := r.instance(requestFormat)
+	if err != nil {
+		return nil, fmt.Errorf("request format: %w", err)
+	}
+	resp, err := r.instance(responseFormat)
+	if err != nil {
+		return nil, fmt.Errorf("response format: %w", err)
+	}
+	if req == resp {
+		return req, nil
+	}
+	return Pair{
+		RequestConverter:  req,
+		ResponseConverter: resp,
+	}, nil
+}
+
+func (r *Router) routes(rules map[string]string) ([]route, error) {
+	result := make([]route, 0, len(rules))
+	for prefix, format := range rules {
+		requestFormat, responseFormat := format, format
+		if formats := strings.SplitN(format, formatSeparator, 2); len(formats) == 2 {
+			requestFormat, responseFormat = formats[0], formats[1]
+		}
+		c, err := r.pair(requestFormat, responseFormat)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, route{prefix: strings.ToLower(prefix), converter: c})
+	}
+	// the longest prefix takes precedence
+	sort.Slice(result, func(i, j int) bool {
+		return len(result[i].prefix) > len(result[j].prefix)
+	})
+	return result, nil
+}
+
+// Select returns the converter for the request. Path rules are matched first,
+// then the content type rules. Default converter is returned if none matches.
+func (r *Router) Select(req *http.Request) Converter {
+	path := strings.ToLower(req.URL.Path)
+	for _, p := range r.paths {
+		if strings.HasPrefix(path, p.prefix) {
+			return p.converter
+		}
+	}
+	contentType := strings.ToLower(req.Header.Get("Content-Type"))
+	for _, ct := range r.contentTypes {
+		if strings.HasPrefix(contentType, ct.prefix) {
+			return ct.converter
+		}
+	}
+	return r.fallback
+}
@@ -0,0 +1,195 @@
+/*
+Copyright 2023 Triggermesh Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package idempotency
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+	"go.uber.org/zap"
+
+	"github.com/triggermesh/aws-custom-runtime/pkg/converter"
+	"github.com/triggermesh/aws-custom-runtime/pkg/converter/cloudevents"
+	"github.com/triggermesh/aws-custom-runtime/pkg/jsonpath"
+)
+
+// Idempotency key sources.
+const (
+	// KeyCloudEvent identifies the requests by the CloudEvent source and id.
+	KeyCloudEvent = "cloudevent"
+
+	keyHeaderPrefix   = "header:"
+	keyJSONPathPrefix = "jsonpath:"
+)
+
+// Result is the function invocation result shared by the duplicate requests.
+type Result struct {
+	Data       []byte
+	StatusCode int
+}
+
+// Guard runs the function once per idempotency key: the result is cached
+// for the TTL and concurrent duplicates wait for the running invocation.
+type Guard struct {
+	// TTL is the time the successful invocation results are kept.
+	TTL time.Duration `envconfig:"ttl" default:"10m"`
+	// Store is the name of the results store.
+	Store string `envconfig:"store" default:"memory"`
+
+	expression string
+	store      Store
+	logger     *zap.SugaredLogger
+
+	mu       sync.Mutex
+	inflight map[string]*call
+}
+
+type call struct {
+	done   chan struct{}
+	result Result
+}
+
+// New returns the Guard that reads the idempotency key from the request
+// as set in the key expression: "cloudevent", "header:<name>" or
+// "jsonpath:<expression>" applied to the request body.
+func New(key string, logger *zap.SugaredLogger) (*Guard, error) {
+	g := Guard{
+		expression: key,
+		logger:     logger,
+		inflight:   make(map[string]*call),
+	}
+	if err := envconfig.Process("idempotency", &g); err != nil {
+		return nil, fmt.Errorf("cannot process idempotency env variables: %w", err)
+	}
+	switch {
+	case key == KeyCloudEvent:
+	case strings.HasPrefix(key, keyHeaderPrefix):
+	case strings.HasPrefix(key, keyJSONPathPrefix):
+		if _, err := jsonpath.Get(strings.TrimPrefix(key, keyJSONPathPrefix), nil); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown idempotency key %q", key)
+	}
+
+	store, err := NewStore(g.Store)
+	if err != nil {
+		return nil, err
+	}
+	g.store = store
+	return &g, nil
+}
+
+// Keys returns the idempotency keys of the converted request items.
+// Items without the key get an empty string. Header keys of the batched
+// items are suffixed with the item index since they share the request.
+func (g *Guard) Keys(header http.Header, items []converter.Item) []string {
+	keys := make([]string, len(items))
+	if g == nil {
+		return keys
+	}
+	for i, item := range items {
+		keys[i] = g.key(header, item)
+		if keys[i] != "" && len(items) > 1 && strings.HasPrefix(g.expression, keyHeaderPrefix) {
+			keys[i] += "/" + strconv.Itoa(i)
+		}
+	}
+	return keys
+}
+
+func (g *Guard) key(header http.Header, item converter.Item) string {
+	switch {
+	case g.expression == KeyCloudEvent:
+		var attributes map[string]interface{}
+		if err := json.Unmarshal([]byte(item.Context[cloudevents.CeContextKey]), &attributes); err != nil {
+			return ""
+		}
+		id, _ := attributes["id"].(string)
+		source, _ := attributes["source"].(string)
+		if id == "" {
+			return ""
+		}
+		return source + "/" + id
+	case strings.HasPrefix(g.expression, keyHeaderPrefix):
+		return header.Get(strings.TrimPrefix(g.expression, keyHeaderPrefix))
+	case strings.HasPrefix(g.expression, keyJSONPathPrefix):
+		var data interface{}
+		if err := json.Unmarshal(item.Data, &data); err != nil {
+			return ""
+		}
+		value, _ := jsonpath.Get(strings.TrimPrefix(g.expression, keyJSONPathPrefix), data)
+		return value
+	}
+	return ""
+}
+
+// Do returns the cached result of the key or runs the invocation. Concurrent
+// calls with the same key share the single invocation. Only successful
+// results are cached so that the failed requests can be retried.
+func (g *Guard) Do(key string, invoke func() Result) Result {
+	if g == nil || key == "" {
+		return invoke()
+	}
+
+	// the call is registered before the store lookup, so that the duplicates
+	// either wait for it or find the result it has stored
+	g.mu.Lock()
+	if c, exists := g.inflight[key]; exists {
+		g.mu.Unlock()
+		<-c.done
+		return c.result
+	}
+	c := &call{done: make(chan struct{})}
+	g.inflight[key] = c
+	g.mu.Unlock()
+
+	// the duplicates are released even if the invocation panics,
+	// in which case they get the error result set below
+	c.result = Result{
+		Data:       converter.NewError(converter.ErrorTypeUnhandled, http.StatusInternalServerError, "Invocation of %q failed", key).JSON(),
+		StatusCode: http.StatusInternalServerError,
+	}
+	defer func() {
+		g.mu.Lock()
+		delete(g.inflight, key)
+		g.mu.Unlock()
+		close(c.done)
+	}()
+
+	cached, err := g.store.Get(key)
+	if err != nil {
+		g.logger.Errorf("Cannot read idempotency store: %v", err)
+	}
+	if cached != nil {
+		g.logger.Debugf("Returning cached result of %q", key)
+		c.result = *cached
+	} else {
+		c.result = invoke()
+		if c.result.StatusCode < http.StatusBadRequest {
+			if err := g.store.Set(key, &c.result, g.TTL); err != nil {
+				g.logger.Errorf("Cannot write idempotency store: %v", err)
+			}
+		}
+	}
+	return c.result
+}
@@ -0,0 +1,236 @@
+package idempotency
+
+import (
+	"net/http"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/triggermesh/aws-custom-runtime/pkg/converter"
+	"github.com/triggermesh/aws-custom-runtime/pkg/converter/cloudevents"
+)
+
+func newTestGuard(t *testing.T, key string) *Guard {
+	g, err := New(key, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+func TestKeys(t *testing.T) {
+	header := http.Header{}
+	header.Set("Idempotency-Key", "abc")
+	items := []converter.Item{
+		{
+			Data:    []byte(`{"order":{"id":"o-1"}}`),
+			Context: map[string]string{cloudevents.CeContextKey: `{"id":"1","source":"orders","type":"order.created"}`},
+		},
+		{
+			Data: []byte(`not json`),
+		},
+	}
+
+	tests := []struct {
+		key      string
+		expected []string
+	}{
+		{key: "cloudevent", expected: []string{"orders/1", ""}},
+		{key: "header:Idempotency-Key", expected: []string{"abc/0", "abc/1"}},
+		{key: "jsonpath:$.order.id", expected: []string{"o-1", ""}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			keys := newTestGuard(t, tt.key).Keys(header, items)
+			if !reflect.DeepEqual(keys, tt.expected) {
+				t.Errorf("Got %q keys, want %q", keys, tt.expected)
+			}
+		})
+	}
+
+	if keys := newTestGuard(t, "header:Idempotency-Key").Keys(header, items[:1]); keys[0] != "abc" {
+		t.Errorf("Got %q key of the single item, want %q", keys[0], "abc")
+	}
+	var disabled *Guard
+	if keys := disabled.Keys(header, items); !reflect.DeepEqual(keys, []string{"", ""}) {
+		t.Errorf("Got %q keys of the disabled guard", keys)
+	}
+	if _, err := New("body", zap.NewNop().Sugar()); err == nil {
+		t.Error("Unknown key expression expected to fail")
+	}
+}
+
+func TestDo(t *testing.T) {
+	g := newTestGuard(t, "cloudevent")
+
+	var invocations int32
+	release := make(chan struct{})
+	invoke := func() Result {
+		atomic.AddInt32(&invocations, 1)
+		<-release
+		return Result{Data: []byte("ok"), StatusCode: http.StatusOK}
+	}
+
+	// concurrent duplicates share the invocation
+	var wg sync.WaitGroup
+	results := make([]Result, 5)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = g.Do("key", invoke)
+		}(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	// later duplicates get the cached result
+	results = append(results, g.Do("key", invoke))
+	if invocations != 1 {
+		t.Errorf("Got %d invocations, want 1", invocations)
+	}
+	for _, r := range results {
+		if string(r.Data) != "ok" {
+			t.Errorf("Got %q result, want %q", r.Data, "ok")
+		}
+	}
+
+	// failures are not cached
+	failed := func() Result {
+		atomic.AddInt32(&invocations, 1)
+		return Result{StatusCode: http.StatusInternalServerError}
+	}
+	g.Do("failed", failed)
+	g.Do("failed", failed)
+	if invocations != 3 {
+		t.Errorf("Got %d invocations, want failed requests to be retried", invocations)
+	}
+}
+
+// hookStore runs the hook after the first store lookup.
+type hookStore struct {
+	*Memory
+	called int32
+	hook   func()
+}
+
+func (s *hookStore) Get(key string) (*Result, error) {
+	result, err := s.Memory.Get(key)
+	if atomic.CompareAndSwapInt32(&s.called, 0, 1) {
+		s.hook()
+	}
+	return result, err
+}
+
+func TestDoCompletedDuplicate(t *testing.T) {
+	g := newTestGuard(t, "cloudevent")
+
+	var invocations int32
+	invoke := func() Result {
+		atomic.AddInt32(&invocations, 1)
+		return Result{Data: []byte("ok"), StatusCode: http.StatusOK}
+	}
+
+	// the duplicate runs from start to end while the
+	// first call is between the store lookup and the invocation
+	store := &hookStore{Memory: NewMemory()}
+	store.hook = func() {
+		done := make(chan struct{})
+		go func() {
+			g.Do("key", invoke)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	g.store = store
+
+	if r := g.Do("key", invoke); string(r.Data) != "ok" {
+		t.Errorf("Got %q result, want %q", r.Data, "ok")
+	}
+	time.Sleep(10 * time.Millisecond)
+	if n := atomic.LoadInt32(&invocations); n != 1 {
+		t.Errorf("Got %d invocations, want 1", n)
+	}
+}
+
+func TestDoPanic(t *testing.T) {
+	g := newTestGuard(t, "cloudevent")
+
+	release := make(chan struct{})
+	go func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("Invocation did not panic")
+			}
+		}()
+		g.Do("key", func() Result {
+			<-release
+			panic("boom")
+		})
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	duplicate := make(chan Result)
+	go func() {
+		duplicate <- g.Do("key", func() Result {
+			return Result{Data: []byte("ok"), StatusCode: http.StatusOK}
+		})
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+
+	select {
+	case r := <-duplicate:
+		if r.StatusCode != http.StatusInternalServerError {
+			t.Errorf("Got %d status code, want %d", r.StatusCode, http.StatusInternalServerError)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Duplicate of the panicked invocation is not released")
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(g.inflight) != 0 {
+		t.Errorf("Got %d in-flight calls, want none", len(g.inflight))
+	}
+}
+
+func TestMemory(t *testing.T) {
+	m := NewMemory()
+	if err := m.Set("foo", &Result{Data: []byte("bar")}, 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if r, _ := m.Get("foo"); r == nil || string(r.Data) != "bar" {
+		t.Errorf("Got %v result, want %q", r, "bar")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if r, _ := m.Get("foo"); r != nil {
+		t.Errorf("Got %q expired result", r.Data)
+	}
+
+	// expired entries are swept on write
+	if err := m.Set("baz", &Result{}, 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := m.entries["foo"]; exists {
+		t.Error("Expired entry was not removed")
+	}
+}
+
+func TestNewStore(t *testing.T) {
+	if _, err := NewStore("Memory"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewStore("redis"); err == nil {
+		t.Error("Unknown store expected to fail")
+	}
+}
@@ -0,0 +1,128 @@
+/*
+Copyright 2023 Triggermesh Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package idempotency
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Store keeps the invocation results by their idempotency keys.
+// Implementations must be safe for concurrent use.
+type Store interface {
+	// Get returns the result of the key or nil if there is none.
+	Get(key string) (*Result, error)
+	// Set saves the result of the key for the TTL.
+	Set(key string, result *Result, ttl time.Duration) error
+}
+
+// StoreFactory creates the store. Stores read their own
+// configuration, e.g. the environment variables.
+type StoreFactory func() (Store, error)
+
+// MemoryStore is the store name of the in-memory results cache.
+const MemoryStore = "memory"
+
+var (
+	storesMu sync.RWMutex
+	stores   = make(map[string]StoreFactory)
+)
+
+func init() {
+	RegisterStore(MemoryStore, func() (Store, error) {
+		return NewMemory(), nil
+	})
+}
+
+// RegisterStore makes the store available by the case-insensitive name.
+// It panics if the store with the same name is already registered.
+func RegisterStore(name string, factory StoreFactory) {
+	storesMu.Lock()
+	defer storesMu.Unlock()
+	name = strings.ToLower(name)
+	if _, exists := stores[name]; exists {
+		panic(fmt.Sprintf("idempotency store %q is already registered", name))
+	}
+	stores[name] = factory
+}
+
+// NewStore creates the registered store.
+func NewStore(name string) (Store, error) {
+	storesMu.RLock()
+	factory, exists := stores[strings.ToLower(name)]
+	names := make([]string, 0, len(stores))
+	for n := range stores {
+		names = append(names, n)
+	}
+	storesMu.RUnlock()
+	if !exists {
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown idempotency store %q, supported stores: %s", name, strings.Join(names, ", "))
+	}
+	return factory()
+}
+
+// Memory is the in-process store with the expiring entries.
+type Memory struct {
+	mu        sync.Mutex
+	entries   map[string]entry
+	lastSweep time.Time
+}
+
+type entry struct {
+	result  *Result
+	expires time.Time
+}
+
+// NewMemory returns the empty in-memory store.
+func NewMemory() *Memory {
+	return &Memory{
+		entries:   make(map[string]entry),
+		lastSweep: time.Now(),
+	}
+}
+
+// Get returns the result if it has not expired yet.
+func (m *Memory) Get(key string) (*Result, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, exists := m.entries[key]
+	if !exists || time.Now().After(e.expires) {
+		return nil, nil
+	}
+	return e.result, nil
+}
+
+// Set saves the result and removes the expired entries once in a while.
+func (m *Memory) Set(key string, result *Result, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	m.entries[key] = entry{result: result, expires: now.Add(ttl)}
+	if now.Sub(m.lastSweep) > ttl {
+		for k, e := range m.entries {
+			if now.After(e.expires) {
+				delete(m.entries, k)
+			}
+		}
+		m.lastSweep = now
+	}
+	return nil
+}
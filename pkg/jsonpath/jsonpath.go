@@ -0,0 +1,73 @@
+/*
+Copyright 2023 Triggermesh Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package jsonpath
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var segment = regexp.MustCompile(`^(?:\.([^.\[]+)|\['([^']+)'\]|\[(\d+)\])`)
+
+// Get returns the value at the simple JSONPath expression, such as
+// "$.items[0].kind" or "$['detail-type']". Non-string values are JSON encoded,
+// missing values are returned as empty strings.
+func Get(path string, data interface{}) (string, error) {
+	if !strings.HasPrefix(path, "$") {
+		return "", fmt.Errorf("JSONPath %q must start with $", path)
+	}
+	current := data
+	for rest := path[1:]; rest != ""; {
+		match := segment.FindStringSubmatch(rest)
+		if match == nil {
+			return "", fmt.Errorf("unsupported JSONPath expression %q", path)
+		}
+		rest = rest[len(match[0]):]
+
+		switch {
+		case match[3] != "":
+			list, ok := current.([]interface{})
+			index, _ := strconv.Atoi(match[3])
+			if !ok || index >= len(list) {
+				return "", nil
+			}
+			current = list[index]
+		default:
+			key := match[1] + match[2]
+			object, ok := current.(map[string]interface{})
+			if !ok {
+				return "", nil
+			}
+			if current, ok = object[key]; !ok {
+				return "", nil
+			}
+		}
+	}
+
+	switch v := current.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	default:
+		out, err := json.Marshal(v)
+		return string(out), err
+	}
+}
@@ -0,0 +1,40 @@
+package jsonpath
+
+import "testing"
+
+func TestGet(t *testing.T) {
+	data := map[string]interface{}{
+		"detail-type": "Scheduled Event",
+		"items": []interface{}{
+			map[string]interface{}{"kind": "first"},
+		},
+		"count": 2.0,
+	}
+
+	tests := []struct {
+		path     string
+		expected string
+		wantErr  bool
+	}{
+		{path: "$['detail-type']", expected: "Scheduled Event"},
+		{path: "$.items[0].kind", expected: "first"},
+		{path: "$.items[1].kind", expected: ""},
+		{path: "$.count", expected: "2"},
+		{path: "$.missing.key", expected: ""},
+		{path: "items", wantErr: true},
+		{path: "$.items[?(@.kind)]", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got, err := Get(tt.path, data)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Get() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.expected {
+				t.Errorf("Get() got = %q, want %q", got, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,390 @@
+/*
+Copyright 2023 Triggermesh Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kafka
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+	kafkago "github.com/segmentio/kafka-go"
+	"go.uber.org/zap"
+
+	"github.com/triggermesh/aws-custom-runtime/pkg/lambda"
+)
+
+// Kafka event constant attributes.
+const (
+	eventSource   = "SelfManagedKafka"
+	timestampType = "CREATE_TIME"
+)
+
+// Starting positions of the new consumer group.
+const (
+	StartingPositionLatest      = "LATEST"
+	StartingPositionTrimHorizon = "TRIM_HORIZON"
+)
+
+// Event is the payload AWS Lambda receives from the self-managed
+// Apache Kafka event source.
+type Event struct {
+	EventSource      string              `json:"eventSource"`
+	BootstrapServers string              `json:"bootstrapServers"`
+	Records          map[string][]Record `json:"records"`
+}
+
+// Record is the Kafka message with base64 encoded key and value.
+type Record struct {
+	Topic         string                  `json:"topic"`
+	Partition     int                     `json:"partition"`
+	Offset        int64                   `json:"offset"`
+	Timestamp     int64                   `json:"timestamp"`
+	TimestampType string                  `json:"timestampType"`
+	Key           string                  `json:"key,omitempty"`
+	Value         string                  `json:"value"`
+	Headers       []map[string]byteValues `json:"headers"`
+}
+
+// byteValues are encoded as the array of numbers, the same way as
+// the record header values in Lambda Kafka events.
+type byteValues []byte
+
+func (b byteValues) MarshalJSON() ([]byte, error) {
+	numbers := make([]int, len(b))
+	for i, v := range b {
+		numbers[i] = int(v)
+	}
+	return json.Marshal(numbers)
+}
+
+// BatchResponse is the function response that reports failed records.
+// Its shape follows the SQS batch item failures, but since AWS Lambda does
+// not support them for Kafka, the item identifier is specific to this runtime.
+type BatchResponse struct {
+	BatchItemFailures []struct {
+		ItemIdentifier ItemIdentifier `json:"itemIdentifier"`
+	} `json:"batchItemFailures"`
+}
+
+// ItemIdentifier points at the failed record. Empty topic matches
+// the record of any topic.
+type ItemIdentifier struct {
+	Topic     string `json:"topic"`
+	Partition int    `json:"partition"`
+	Offset    int64  `json:"offset"`
+}
+
+// reader is the part of the Kafka consumer group reader used by the Consumer.
+type reader interface {
+	FetchMessage(ctx context.Context) (kafkago.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafkago.Message) error
+	Close() error
+}
+
+// writer is the part of the Kafka writer used for the dead-letter topic.
+type writer interface {
+	WriteMessages(ctx context.Context, msgs ...kafkago.Message) error
+}
+
+// Consumer reads the topics as a consumer group member and invokes
+// the function with the batches of records. Offsets are committed
+// only for the records processed successfully.
+type Consumer struct {
+	// Topics are the consumed Kafka topics.
+	Topics []string `envconfig:"topics" required:"true"`
+	// GroupID is the consumer group of the runtime instances.
+	GroupID string `envconfig:"group_id" default:"custom-runtime"`
+	// StartingPosition is used by the new consumer group, "LATEST" or "TRIM_HORIZON".
+	StartingPosition string `envconfig:"starting_position" default:"LATEST"`
+	// BatchSize limits the number of records in the event.
+	BatchSize int `envconfig:"batch_size" default:"100"`
+	// BatchWindow is the time to gather the batch after the first record.
+	BatchWindow time.Duration `envconfig:"batch_window" default:"500ms"`
+	// RetryDelay is the pause before the failed records are invoked again.
+	RetryDelay time.Duration `envconfig:"retry_delay" default:"1s"`
+	// MaxRetries limits the repeated invocations of the failed records,
+	// -1 retries them until they succeed.
+	MaxRetries int `envconfig:"max_retries" default:"3"`
+	// DeadLetterTopic receives the records that failed after all retries.
+	// Such records are skipped if the topic is not set.
+	DeadLetterTopic string `envconfig:"dead_letter_topic"`
+
+	brokers    []string
+	newReader  func() reader
+	deadLetter writer
+	invoke     lambda.Invoke
+	logger     *zap.SugaredLogger
+}
+
+// New returns the Consumer of the configured topics at the brokers.
+func New(brokers []string, invoke lambda.Invoke, logger *zap.SugaredLogger) (*Consumer, error) {
+	c := Consumer{
+		brokers: brokers,
+		invoke:  invoke,
+		logger:  logger,
+	}
+	if err := envconfig.Process("kafka", &c); err != nil {
+		return nil, fmt.Errorf("cannot process Kafka consumer env variables: %w", err)
+	}
+	startOffset := kafkago.LastOffset
+	switch strings.ToUpper(c.StartingPosition) {
+	case StartingPositionLatest:
+	case StartingPositionTrimHorizon:
+		startOffset = kafkago.FirstOffset
+	default:
+		return nil, fmt.Errorf("unknown starting position %q", c.StartingPosition)
+	}
+	if c.BatchSize < 1 {
+		return nil, fmt.Errorf("batch size must be positive, got %d", c.BatchSize)
+	}
+	if c.MaxRetries < -1 {
+		return nil, fmt.Errorf("max retries must be -1 or greater, got %d", c.MaxRetries)
+	}
+	if c.DeadLetterTopic != "" {
+		c.deadLetter = &kafkago.Writer{
+			Addr:         kafkago.TCP(brokers...),
+			Topic:        c.DeadLetterTopic,
+			RequiredAcks: kafkago.RequireAll,
+		}
+	}
+
+	c.newReader = func() reader {
+		return kafkago.NewReader(kafkago.ReaderConfig{
+			Brokers:     brokers,
+			GroupID:     c.GroupID,
+			GroupTopics: c.Topics,
+			StartOffset: startOffset,
+		})
+	}
+	return &c, nil
+}
+
+// Run consumes the topics until the context is done. Group reader restarts
+// from the committed offsets if fetching or committing fails.
+func (c *Consumer) Run(ctx context.Context) {
+	for ctx.Err() == nil {
+		r := c.newReader()
+		err := c.consume(ctx, r)
+		if err := r.Close(); err != nil {
+			c.logger.Errorf("Cannot close Kafka reader: %v", err)
+		}
+		if err == nil || ctx.Err() != nil {
+			continue
+		}
+		c.logger.Errorf("Kafka consumer: %v", err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(c.RetryDelay):
+		}
+	}
+}
+
+// consume processes the batches until the reader fails.
+func (c *Consumer) consume(ctx context.Context, r reader) error {
+	for {
+		batch, err := c.fetch(ctx, r)
+		if err != nil {
+			return fmt.Errorf("cannot fetch messages: %w", err)
+		}
+		if err := c.deliver(ctx, r, batch); err != nil {
+			return err
+		}
+	}
+}
+
+// deliver invokes the function with the batch until all its records are
+// committed. Failed records are invoked again after the retry delay together
+// with the records that follow them in the same partition, without fetching
+// them from the broker. Records that failed after all retries are sent to
+// the dead-letter topic, if it is set, and committed.
+func (c *Consumer) deliver(ctx context.Context, r reader, batch []kafkago.Message) error {
+	for attempt := 0; ; attempt++ {
+		succeeded, rest, err := c.process(ctx, batch)
+		if len(succeeded) != 0 {
+			if err := r.CommitMessages(ctx, succeeded...); err != nil {
+				return fmt.Errorf("cannot commit offsets: %w", err)
+			}
+		}
+		if err == nil {
+			return nil
+		}
+		batch = rest
+		if c.MaxRetries != -1 && attempt >= c.MaxRetries {
+			return c.drop(ctx, r, batch, err)
+		}
+		c.logger.Errorf("Kafka records failed, retrying %d records: %v", len(batch), err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(c.RetryDelay):
+		}
+	}
+}
+
+// drop sends the failed records to the dead-letter topic and commits them.
+func (c *Consumer) drop(ctx context.Context, r reader, batch []kafkago.Message, cause error) error {
+	if c.deadLetter != nil {
+		if err := c.deadLetter.WriteMessages(ctx, deadLetterMessages(batch)...); err != nil {
+			return fmt.Errorf("cannot send %d failed records to dead-letter topic: %w", len(batch), err)
+		}
+		c.logger.Errorf("Kafka records are sent to dead-letter topic after %d retries: %v", c.MaxRetries, cause)
+	} else {
+		c.logger.Errorf("Kafka records are skipped after %d retries: %v", c.MaxRetries, cause)
+	}
+	if err := r.CommitMessages(ctx, batch...); err != nil {
+		return fmt.Errorf("cannot commit offsets: %w", err)
+	}
+	return nil
+}
+
+// deadLetterMessages copies the keys, values and headers of the records.
+func deadLetterMessages(batch []kafkago.Message) []kafkago.Message {
+	messages := make([]kafkago.Message, len(batch))
+	for i, m := range batch {
+		messages[i] = kafkago.Message{
+			Key:     m.Key,
+			Value:   m.Value,
+			Headers: m.Headers,
+		}
+	}
+	return messages
+}
+
+// fetch blocks until the first message and then gathers the batch
+// during the batch window.
+func (c *Consumer) fetch(ctx context.Context, r reader) ([]kafkago.Message, error) {
+	first, err := r.FetchMessage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	batch := []kafkago.Message{first}
+
+	windowCtx, cancel := context.WithTimeout(ctx, c.BatchWindow)
+	defer cancel()
+	for len(batch) < c.BatchSize {
+		m, err := r.FetchMessage(windowCtx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			break
+		}
+		batch = append(batch, m)
+	}
+	return batch, nil
+}
+
+// process invokes the function with the batch and splits it into the messages
+// that can be committed: in each partition, the ones before the first failure,
+// and the rest of the messages.
+func (c *Consumer) process(ctx context.Context, batch []kafkago.Message) ([]kafkago.Message, []kafkago.Message, error) {
+	event, err := json.Marshal(c.event(batch))
+	if err != nil {
+		return nil, batch, fmt.Errorf("cannot encode Kafka event: %w", err)
+	}
+	response, statusCode := c.invoke(ctx, event)
+	if statusCode >= http.StatusBadRequest {
+		return nil, batch, fmt.Errorf("function failed with %d status: %s", statusCode, response)
+	}
+
+	failures := failedItems(response)
+	if len(failures) == 0 {
+		return batch, nil, nil
+	}
+	// the lowest failed offset in each partition
+	firstFailed := make(map[string]int64)
+	for _, m := range batch {
+		if !failed(failures, m) {
+			continue
+		}
+		key := partitionKey(m.Topic, m.Partition)
+		if offset, exists := firstFailed[key]; !exists || m.Offset < offset {
+			firstFailed[key] = m.Offset
+		}
+	}
+	if len(firstFailed) == 0 {
+		return batch, nil, nil
+	}
+	var succeeded, rest []kafkago.Message
+	for _, m := range batch {
+		if offset, exists := firstFailed[partitionKey(m.Topic, m.Partition)]; !exists || m.Offset < offset {
+			succeeded = append(succeeded, m)
+		} else {
+			rest = append(rest, m)
+		}
+	}
+	return succeeded, rest, fmt.Errorf("function reported %d failed records", len(failures))
+}
+
+func (c *Consumer) event(batch []kafkago.Message) Event {
+	e := Event{
+		EventSource:      eventSource,
+		BootstrapServers: strings.Join(c.brokers, ","),
+		Records:          make(map[string][]Record),
+	}
+	for _, m := range batch {
+		record := Record{
+			Topic:         m.Topic,
+			Partition:     m.Partition,
+			Offset:        m.Offset,
+			Timestamp:     m.Time.UnixNano() / int64(time.Millisecond),
+			TimestampType: timestampType,
+			Value:         base64.StdEncoding.EncodeToString(m.Value),
+			Headers:       make([]map[string]byteValues, 0, len(m.Headers)),
+		}
+		if m.Key != nil {
+			record.Key = base64.StdEncoding.EncodeToString(m.Key)
+		}
+		for _, h := range m.Headers {
+			record.Headers = append(record.Headers, map[string]byteValues{h.Key: h.Value})
+		}
+		key := partitionKey(m.Topic, m.Partition)
+		e.Records[key] = append(e.Records[key], record)
+	}
+	return e
+}
+
+// failedItems reads the batch item failures from the function response.
+func failedItems(response []byte) []ItemIdentifier {
+	var r BatchResponse
+	if err := json.Unmarshal(response, &r); err != nil {
+		return nil
+	}
+	items := make([]ItemIdentifier, len(r.BatchItemFailures))
+	for i, f := range r.BatchItemFailures {
+		items[i] = f.ItemIdentifier
+	}
+	return items
+}
+
+func failed(failures []ItemIdentifier, m kafkago.Message) bool {
+	for _, f := range failures {
+		if (f.Topic == "" || f.Topic == m.Topic) && f.Partition == m.Partition && f.Offset == m.Offset {
+			return true
+		}
+	}
+	return false
+}
+
+func partitionKey(topic string, partition int) string {
+	return fmt.Sprintf("%s-%d", topic, partition)
+}
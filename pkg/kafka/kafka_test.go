@@ -0,0 +1,216 @@
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	kafkago "github.com/segmentio/kafka-go"
+	"go.uber.org/zap"
+)
+
+// fakeReader is the in-memory stand-in of the consumer group reader.
+type fakeReader struct {
+	messages  []kafkago.Message
+	committed []int64
+}
+
+func (r *fakeReader) FetchMessage(ctx context.Context) (kafkago.Message, error) {
+	if len(r.messages) == 0 {
+		<-ctx.Done()
+		return kafkago.Message{}, ctx.Err()
+	}
+	m := r.messages[0]
+	r.messages = r.messages[1:]
+	return m, nil
+}
+
+func (r *fakeReader) CommitMessages(ctx context.Context, msgs ...kafkago.Message) error {
+	for _, m := range msgs {
+		r.committed = append(r.committed, m.Offset)
+	}
+	return nil
+}
+
+func (r *fakeReader) Close() error {
+	return nil
+}
+
+func messages() []kafkago.Message {
+	t := time.Date(2023, time.March, 1, 10, 30, 0, 0, time.UTC)
+	return []kafkago.Message{
+		{Topic: "orders", Partition: 0, Offset: 10, Value: []byte("a"), Time: t},
+		{Topic: "orders", Partition: 0, Offset: 11, Value: []byte("b"), Time: t},
+		{Topic: "orders", Partition: 0, Offset: 12, Value: []byte("c"), Time: t},
+		{Topic: "orders", Partition: 1, Offset: 5, Key: []byte("k"), Value: []byte("d"), Time: t,
+			Headers: []kafkago.Header{{Key: "trace", Value: []byte("hi")}}},
+	}
+}
+
+func TestEvent(t *testing.T) {
+	c := &Consumer{brokers: []string{"kafka-1:9092", "kafka-2:9092"}}
+
+	data, err := json.Marshal(c.event(messages()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var event map[string]interface{}
+	if err := json.Unmarshal(data, &event); err != nil {
+		t.Fatal(err)
+	}
+	if event["eventSource"] != "SelfManagedKafka" || event["bootstrapServers"] != "kafka-1:9092,kafka-2:9092" {
+		t.Errorf("Got %s event", data)
+	}
+	records := event["records"].(map[string]interface{})
+	if len(records["orders-0"].([]interface{})) != 3 {
+		t.Errorf("Got %v records of orders-0 partition", records["orders-0"])
+	}
+	record := records["orders-1"].([]interface{})[0].(map[string]interface{})
+	expected := map[string]interface{}{
+		"topic":         "orders",
+		"partition":     float64(1),
+		"offset":        float64(5),
+		"timestamp":     float64(1677666600000),
+		"timestampType": "CREATE_TIME",
+		"key":           "aw==",
+		"value":         "ZA==",
+		"headers":       []interface{}{map[string]interface{}{"trace": []interface{}{float64(104), float64(105)}}},
+	}
+	if !reflect.DeepEqual(record, expected) {
+		t.Errorf("Got %v record, want %v", record, expected)
+	}
+}
+
+// fakeWriter records the messages of the dead-letter topic.
+type fakeWriter struct {
+	messages []kafkago.Message
+	err      error
+}
+
+func (w *fakeWriter) WriteMessages(ctx context.Context, msgs ...kafkago.Message) error {
+	if w.err != nil {
+		return w.err
+	}
+	w.messages = append(w.messages, msgs...)
+	return nil
+}
+
+func TestConsume(t *testing.T) {
+	const poison = `{"batchItemFailures":[{"itemIdentifier":{"partition":0,"offset":11}}]}`
+
+	tests := []struct {
+		name                string
+		responses           []string
+		statusCodes         []int
+		deadLetter          *fakeWriter
+		expectedCommitted   []int64
+		expectedInvocations [][]int64
+		expectedDeadLetter  []string
+		wantErr             bool
+	}{
+		{
+			name:                "Success",
+			responses:           []string{`{}`},
+			statusCodes:         []int{http.StatusOK},
+			expectedCommitted:   []int64{10, 11, 12, 5},
+			expectedInvocations: [][]int64{{10, 11, 12, 5}},
+		},
+		{
+			name:                "Function error is retried",
+			responses:           []string{`{"errorMessage":"boom"}`, `{}`},
+			statusCodes:         []int{http.StatusInternalServerError, http.StatusOK},
+			expectedCommitted:   []int64{10, 11, 12, 5},
+			expectedInvocations: [][]int64{{10, 11, 12, 5}, {10, 11, 12, 5}},
+		},
+		{
+			name:                "Batch item failure is retried",
+			responses:           []string{poison, `{}`},
+			statusCodes:         []int{http.StatusOK, http.StatusOK},
+			expectedCommitted:   []int64{10, 5, 11, 12},
+			expectedInvocations: [][]int64{{10, 11, 12, 5}, {11, 12}},
+		},
+		{
+			name:                "Poison record is skipped",
+			responses:           []string{poison, poison},
+			statusCodes:         []int{http.StatusOK, http.StatusOK},
+			expectedCommitted:   []int64{10, 5, 11, 12},
+			expectedInvocations: [][]int64{{10, 11, 12, 5}, {11, 12}},
+		},
+		{
+			name:                "Poison record is dead-lettered",
+			responses:           []string{poison, poison},
+			statusCodes:         []int{http.StatusOK, http.StatusOK},
+			deadLetter:          &fakeWriter{},
+			expectedCommitted:   []int64{10, 5, 11, 12},
+			expectedInvocations: [][]int64{{10, 11, 12, 5}, {11, 12}},
+			expectedDeadLetter:  []string{"b", "c"},
+		},
+		{
+			name:                "Dead-letter topic failure",
+			responses:           []string{poison, poison},
+			statusCodes:         []int{http.StatusOK, http.StatusOK},
+			deadLetter:          &fakeWriter{err: errors.New("broker is down")},
+			expectedCommitted:   []int64{10, 5},
+			expectedInvocations: [][]int64{{10, 11, 12, 5}, {11, 12}},
+			wantErr:             true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &fakeReader{messages: messages()}
+			var invocations [][]int64
+			c := &Consumer{
+				BatchSize:   10,
+				BatchWindow: 10 * time.Millisecond,
+				RetryDelay:  time.Millisecond,
+				MaxRetries:  1,
+				invoke: func(ctx context.Context, event []byte) ([]byte, int) {
+					var e Event
+					if err := json.Unmarshal(event, &e); err != nil {
+						t.Fatal(err)
+					}
+					var offsets []int64
+					for _, key := range []string{"orders-0", "orders-1"} {
+						for _, record := range e.Records[key] {
+							offsets = append(offsets, record.Offset)
+						}
+					}
+					i := len(invocations)
+					invocations = append(invocations, offsets)
+					return []byte(tt.responses[i]), tt.statusCodes[i]
+				},
+				logger: zap.NewNop().Sugar(),
+			}
+			if tt.deadLetter != nil {
+				c.deadLetter = tt.deadLetter
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			err := c.consume(ctx, r)
+			if failed := err != nil && ctx.Err() == nil; failed != tt.wantErr {
+				t.Errorf("consume() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(r.committed, tt.expectedCommitted) {
+				t.Errorf("Got %v committed offsets, want %v", r.committed, tt.expectedCommitted)
+			}
+			if !reflect.DeepEqual(invocations, tt.expectedInvocations) {
+				t.Errorf("Got %v invoked offsets, want %v", invocations, tt.expectedInvocations)
+			}
+			if tt.deadLetter != nil {
+				var values []string
+				for _, m := range tt.deadLetter.messages {
+					values = append(values, string(m.Value))
+				}
+				if !reflect.DeepEqual(values, tt.expectedDeadLetter) {
+					t.Errorf("Got %v dead-lettered values, want %v", values, tt.expectedDeadLetter)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,33 @@
+/*
+Copyright 2023 Triggermesh Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package lambda holds the parts of the Lambda environment shared by the
+// runtime event sources and converters.
+package lambda
+
+import "context"
+
+// Account and Region stand in for the AWS account and region in the ARNs
+// and request contexts of the generated events. The runtime is not bound
+// to any of them.
+const (
+	Account = "123456789012"
+	Region  = "us-east-1"
+)
+
+// Invoke passes the event to the function and returns its response.
+// Context carries the trace of the invocation.
+type Invoke func(ctx context.Context, event []byte) (response []byte, statusCode int)
@@ -0,0 +1,68 @@
+/*
+Copyright 2023 Triggermesh Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logger
+
+import (
+	"bytes"
+	"sync"
+)
+
+// maxLineSize limits the buffered output without the line break.
+const maxLineSize = 256 * 1024
+
+// LineWriter passes the written output to the callback line by line,
+// e.g. to log the output of the bootstrap processes.
+type LineWriter struct {
+	mu   sync.Mutex
+	buf  bytes.Buffer
+	emit func(line string)
+}
+
+// NewLineWriter returns the writer that calls emit for each line.
+func NewLineWriter(emit func(line string)) *LineWriter {
+	return &LineWriter{emit: emit}
+}
+
+// Write emits the complete lines and buffers the rest of the output.
+func (w *LineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf.Write(p)
+	for {
+		i := bytes.IndexByte(w.buf.Bytes(), '\n')
+		if i < 0 {
+			break
+		}
+		line := w.buf.Next(i + 1)
+		w.emit(string(bytes.TrimRight(line, "\r\n")))
+	}
+	if w.buf.Len() > maxLineSize {
+		w.emit(w.buf.String())
+		w.buf.Reset()
+	}
+	return len(p), nil
+}
+
+// Flush emits the buffered output without the line break.
+func (w *LineWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.buf.Len() != 0 {
+		w.emit(w.buf.String())
+		w.buf.Reset()
+	}
+}
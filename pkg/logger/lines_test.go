@@ -0,0 +1,36 @@
+package logger
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLineWriter(t *testing.T) {
+	var lines []string
+	w := NewLineWriter(func(line string) {
+		lines = append(lines, line)
+	})
+
+	for _, chunk := range []string{"first\nsec", "ond\r\n", "\nthi", "rd"} {
+		if _, err := w.Write([]byte(chunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := []string{"first", "second", ""}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Got %q lines, want %q", lines, expected)
+	}
+
+	w.Flush()
+	expected = append(expected, "third")
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Got %q lines after flush, want %q", lines, expected)
+	}
+
+	lines = nil
+	w.Write([]byte(strings.Repeat("x", maxLineSize+1)))
+	if len(lines) != 1 || len(lines[0]) != maxLineSize+1 {
+		t.Errorf("Got %d lines, want the long line to be emitted", len(lines))
+	}
+}
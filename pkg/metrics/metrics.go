@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/kelseyhightower/envconfig"
@@ -44,6 +45,12 @@ type env struct {
 	ResourceGroup string `envconfig:"resource_group" default:"functions.extensions.triggermesh.io"`
 	// PrometheusPort is the port number where metrics exporter will be running
 	PrometheusPort string `envconfig:"metrics_prometheus_port" default:"9092"`
+	// Exporters is the list of metrics exporters: prometheus, otlp or none.
+	Exporters []string `envconfig:"otel_metrics_exporter" default:"prometheus"`
+	// OTLPProtocol is the OTLP metrics transport: grpc or http/protobuf.
+	OTLPProtocol string `envconfig:"otel_exporter_otlp_metrics_protocol"`
+	// Protocol is the OTLP transport of all signals.
+	Protocol string `envconfig:"otel_exporter_otlp_protocol" default:"http/protobuf"`
 }
 
 // Names for exported metrics.
@@ -51,6 +58,16 @@ const (
 	metricNameEventProcessingSuccessCount = "event_processing_success_count"
 	metricNameEventProcessingErrorCount   = "event_processing_error_count"
 	metricNameEventProcessingLatencies    = "event_processing_latencies"
+	metricNameEventDeliveryAttemptCount   = "event_delivery_attempt_count"
+	metricNameEventDeliveryFailureCount   = "event_delivery_failure_count"
+	metricNameFunctionInitLatencies       = "function_init_latencies"
+	metricNameInvocationCount             = "invocation_count"
+	metricNameInvocationQueueLatencies    = "invocation_queue_latencies"
+	metricNameInvocationLatencies         = "invocation_execution_latencies"
+	metricNameInvocationTimeoutCount      = "invocation_timeout_count"
+	metricNameQueueDepth                  = "invocation_queue_depth"
+	metricNameBusyInvokers                = "invokers_busy"
+	metricNameIdleInvokers                = "invokers_idle"
 )
 
 // Tags for exported metrics.
@@ -61,6 +78,10 @@ var (
 	tagKeyEventType      = tag.MustNewKey("event_type")
 	tagKeyEventSource    = tag.MustNewKey("event_source")
 	tagKeyUserManagedErr = tag.MustNewKey("user_managed")
+	tagKeyResponseCode   = tag.MustNewKey("response_code")
+	tagKeyDeadLettered   = tag.MustNewKey("dead_lettered")
+	tagKeyInvoker        = tag.MustNewKey("invoker")
+	tagKeyColdStart      = tag.MustNewKey("cold_start")
 )
 
 // eventProcessingSuccessCountM is a measure of the number of events that were
@@ -87,9 +108,87 @@ var eventProcessingLatenciesM = stats.Int64(
 	stats.UnitMilliseconds,
 )
 
-// registerEventProcessingStatsView registers an OpenCensus stats view for
-// metrics related to events processing, and panics in case of error.
-func registerEventProcessingStatsView() error {
+// eventDeliveryAttemptCountM is a measure of the number of requests
+// sent to the sinks.
+var eventDeliveryAttemptCountM = stats.Int64(
+	metricNameEventDeliveryAttemptCount,
+	"Number of attempts to deliver events to the sink",
+	stats.UnitDimensionless,
+)
+
+// eventDeliveryFailureCountM is a measure of the number of events
+// that were not delivered to the sink after all attempts.
+var eventDeliveryFailureCountM = stats.Int64(
+	metricNameEventDeliveryFailureCount,
+	"Number of events that could not be delivered to the sink",
+	stats.UnitDimensionless,
+)
+
+// functionInitLatenciesM is a measure of the time between the bootstrap
+// process start and its first request for the invocation.
+var functionInitLatenciesM = stats.Int64(
+	metricNameFunctionInitLatencies,
+	"Time spent by the bootstrap process initializing the Function",
+	stats.UnitMilliseconds,
+)
+
+// invocationCountM is a measure of the number of function invocations.
+var invocationCountM = stats.Int64(
+	metricNameInvocationCount,
+	"Number of Function invocations",
+	stats.UnitDimensionless,
+)
+
+// invocationQueueLatenciesM is a measure of the time the invocations
+// wait in the queue for the free bootstrap process.
+var invocationQueueLatenciesM = stats.Int64(
+	metricNameInvocationQueueLatencies,
+	"Time spent by the invocations waiting in the queue",
+	stats.UnitMilliseconds,
+)
+
+// invocationLatenciesM is a measure of the time the function
+// spends executing the invocations.
+var invocationLatenciesM = stats.Int64(
+	metricNameInvocationLatencies,
+	"Time spent by the Function executing the invocations",
+	stats.UnitMilliseconds,
+)
+
+// invocationTimeoutCountM is a measure of the number of invocations
+// that did not complete before the deadline.
+var invocationTimeoutCountM = stats.Int64(
+	metricNameInvocationTimeoutCount,
+	"Number of invocations that timed out",
+	stats.UnitDimensionless,
+)
+
+// queueDepthM is a measure of the number of invocations in the queue.
+var queueDepthM = stats.Int64(
+	metricNameQueueDepth,
+	"Number of invocations waiting in the queue",
+	stats.UnitDimensionless,
+)
+
+// busyInvokersM is a measure of the number of bootstrap processes
+// executing the invocations.
+var busyInvokersM = stats.Int64(
+	metricNameBusyInvokers,
+	"Number of bootstrap processes executing the invocations",
+	stats.UnitDimensionless,
+)
+
+// idleInvokersM is a measure of the number of bootstrap processes
+// waiting for the invocations.
+var idleInvokersM = stats.Int64(
+	metricNameIdleInvokers,
+	"Number of bootstrap processes waiting for the invocations",
+	stats.UnitDimensionless,
+)
+
+// eventProcessingStatsViews returns OpenCensus stats views for
+// metrics related to events processing.
+func eventProcessingStatsViews() []*view.View {
 	commonTagKeys := []tag.Key{
 		tagKeyName,
 		tagKeyResourceGroup,
@@ -98,14 +197,14 @@ func registerEventProcessingStatsView() error {
 		tagKeyEventSource,
 	}
 
-	return view.Register(
-		&view.View{
+	return []*view.View{
+		{
 			Measure:     eventProcessingSuccessCountM,
 			Description: eventProcessingSuccessCountM.Description(),
 			Aggregation: view.Count(),
 			TagKeys:     commonTagKeys,
 		},
-		&view.View{
+		{
 			Measure:     eventProcessingErrorCountM,
 			Description: eventProcessingErrorCountM.Description(),
 			Aggregation: view.Count(),
@@ -113,42 +212,231 @@ func registerEventProcessingStatsView() error {
 				tagKeyUserManagedErr,
 			),
 		},
-		&view.View{
+		{
 			Measure:     eventProcessingLatenciesM,
 			Description: eventProcessingLatenciesM.Description(),
 			Aggregation: view.Distribution(0, 10, 20, 30, 40, 50, 100, 200, 500, 1000, 2000, 5000, 10000),
 			TagKeys:     commonTagKeys,
 		},
-	)
+		{
+			Measure:     eventDeliveryAttemptCountM,
+			Description: eventDeliveryAttemptCountM.Description(),
+			Aggregation: view.Count(),
+			TagKeys: []tag.Key{
+				tagKeyName,
+				tagKeyResourceGroup,
+				tagKeyNamespace,
+				tagKeyResponseCode,
+			},
+		},
+		{
+			Measure:     eventDeliveryFailureCountM,
+			Description: eventDeliveryFailureCountM.Description(),
+			Aggregation: view.Count(),
+			TagKeys: []tag.Key{
+				tagKeyName,
+				tagKeyResourceGroup,
+				tagKeyNamespace,
+				tagKeyDeadLettered,
+			},
+		},
+	}
+}
+
+// invocationStatsViews returns OpenCensus stats views for
+// metrics related to the function invocations.
+func invocationStatsViews() []*view.View {
+	commonTagKeys := []tag.Key{
+		tagKeyName,
+		tagKeyResourceGroup,
+		tagKeyNamespace,
+	}
+	latencyBuckets := view.Distribution(0, 10, 20, 30, 40, 50, 100, 200, 500, 1000, 2000, 5000, 10000)
+
+	return []*view.View{
+		{
+			Measure:     functionInitLatenciesM,
+			Description: functionInitLatenciesM.Description(),
+			Aggregation: latencyBuckets,
+			TagKeys:     append(commonTagKeys, tagKeyInvoker),
+		},
+		{
+			Measure:     invocationCountM,
+			Description: invocationCountM.Description(),
+			Aggregation: view.Count(),
+			TagKeys:     append(commonTagKeys, tagKeyColdStart),
+		},
+		{
+			Measure:     invocationQueueLatenciesM,
+			Description: invocationQueueLatenciesM.Description(),
+			Aggregation: latencyBuckets,
+			TagKeys:     commonTagKeys,
+		},
+		{
+			Measure:     invocationLatenciesM,
+			Description: invocationLatenciesM.Description(),
+			Aggregation: latencyBuckets,
+			TagKeys:     append(commonTagKeys, tagKeyColdStart),
+		},
+		{
+			Measure:     invocationTimeoutCountM,
+			Description: invocationTimeoutCountM.Description(),
+			Aggregation: view.Count(),
+			TagKeys:     commonTagKeys,
+		},
+		{
+			Measure:     queueDepthM,
+			Description: queueDepthM.Description(),
+			Aggregation: view.LastValue(),
+			TagKeys:     commonTagKeys,
+		},
+		{
+			Measure:     busyInvokersM,
+			Description: busyInvokersM.Description(),
+			Aggregation: view.LastValue(),
+			TagKeys:     commonTagKeys,
+		},
+		{
+			Measure:     idleInvokersM,
+			Description: idleInvokersM.Description(),
+			Aggregation: view.LastValue(),
+			TagKeys:     commonTagKeys,
+		},
+	}
 }
 
 // EventProcessingStatsReporter collects and reports stats about the processing of events.
+// Nil reporter does not record anything.
 type EventProcessingStatsReporter struct {
 	// context that holds pre-populated OpenCensus tags
 	tagsCtx context.Context
+	// otel mirrors the measurements to OpenTelemetry, nil if disabled
+	otel *otelInstruments
+}
+
+// record passes the measurements to OpenCensus and OpenTelemetry.
+func (r *EventProcessingStatsReporter) record(tagsCtx context.Context, ms ...stats.Measurement) {
+	stats.Record(tagsCtx, ms...)
+	r.otel.record(tagsCtx, ms...)
 }
 
 // ReportProcessingSuccess increments eventProcessingSuccessCountM.
 func (r *EventProcessingStatsReporter) ReportProcessingSuccess(tms ...tag.Mutator) {
+	if r == nil {
+		return
+	}
 	tagsCtx, _ := tag.New(r.tagsCtx, tms...)
-	stats.Record(tagsCtx, eventProcessingSuccessCountM.M(1))
+	r.record(tagsCtx, eventProcessingSuccessCountM.M(1))
 }
 
 // ReportProcessingError increments eventProcessingErrorCountM.
 func (r *EventProcessingStatsReporter) ReportProcessingError(userManaged bool, tms ...tag.Mutator) {
+	if r == nil {
+		return
+	}
 	tms = append(tms,
 		tag.Insert(tagKeyUserManagedErr, strconv.FormatBool(userManaged)),
 	)
 
 	tagsCtx, _ := tag.New(r.tagsCtx, tms...)
-	stats.Record(tagsCtx, eventProcessingErrorCountM.M(1))
+	r.record(tagsCtx, eventProcessingErrorCountM.M(1))
 }
 
 // ReportProcessingLatency records in eventProcessingLatenciesM the processing
 // duration of an event.
 func (r *EventProcessingStatsReporter) ReportProcessingLatency(d time.Duration, tms ...tag.Mutator) {
+	if r == nil {
+		return
+	}
 	tagsCtx, _ := tag.New(r.tagsCtx, tms...)
-	stats.Record(tagsCtx, eventProcessingLatenciesM.M(d.Milliseconds()))
+	r.record(tagsCtx, eventProcessingLatenciesM.M(d.Milliseconds()))
+}
+
+// ReportDeliveryAttempt increments eventDeliveryAttemptCountM. Zero status
+// code stands for the request that failed without the sink response.
+func (r *EventProcessingStatsReporter) ReportDeliveryAttempt(statusCode int) {
+	if r == nil {
+		return
+	}
+	code := "error"
+	if statusCode != 0 {
+		code = strconv.Itoa(statusCode)
+	}
+	tagsCtx, _ := tag.New(r.tagsCtx, tag.Insert(tagKeyResponseCode, code))
+	r.record(tagsCtx, eventDeliveryAttemptCountM.M(1))
+}
+
+// ReportDeliveryFailure increments eventDeliveryFailureCountM.
+func (r *EventProcessingStatsReporter) ReportDeliveryFailure(deadLettered bool) {
+	if r == nil {
+		return
+	}
+	tagsCtx, _ := tag.New(r.tagsCtx, tag.Insert(tagKeyDeadLettered, strconv.FormatBool(deadLettered)))
+	r.record(tagsCtx, eventDeliveryFailureCountM.M(1))
+}
+
+// ReportInitDuration records in functionInitLatenciesM the initialization
+// duration of the bootstrap process.
+func (r *EventProcessingStatsReporter) ReportInitDuration(invoker int, d time.Duration) {
+	if r == nil {
+		return
+	}
+	tagsCtx, _ := tag.New(r.tagsCtx, tag.Insert(tagKeyInvoker, strconv.Itoa(invoker)))
+	r.record(tagsCtx, functionInitLatenciesM.M(d.Milliseconds()))
+}
+
+// ReportInvocation increments invocationCountM and records in invocationLatenciesM
+// the execution duration of the invocation. Cold invocations are the first ones
+// executed by the bootstrap process.
+func (r *EventProcessingStatsReporter) ReportInvocation(d time.Duration, cold bool) {
+	if r == nil {
+		return
+	}
+	tagsCtx, _ := tag.New(r.tagsCtx, tag.Insert(tagKeyColdStart, strconv.FormatBool(cold)))
+	r.record(tagsCtx, invocationCountM.M(1), invocationLatenciesM.M(d.Milliseconds()))
+}
+
+// ReportQueueWait records in invocationQueueLatenciesM the time the invocation
+// spent in the queue.
+func (r *EventProcessingStatsReporter) ReportQueueWait(d time.Duration) {
+	if r == nil {
+		return
+	}
+	r.record(r.tagsCtx, invocationQueueLatenciesM.M(d.Milliseconds()))
+}
+
+// ReportTimeout increments invocationTimeoutCountM.
+func (r *EventProcessingStatsReporter) ReportTimeout() {
+	if r == nil {
+		return
+	}
+	r.record(r.tagsCtx, invocationTimeoutCountM.M(1))
+}
+
+// ReportQueueDepth records in queueDepthM the current number of queued
+// invocations.
+func (r *EventProcessingStatsReporter) ReportQueueDepth(depth int) {
+	if r == nil {
+		return
+	}
+	r.record(r.tagsCtx, queueDepthM.M(int64(depth)))
+}
+
+// ReportInvokers records in busyInvokersM and idleInvokersM the current
+// state of the bootstrap processes.
+func (r *EventProcessingStatsReporter) ReportInvokers(busy, idle int) {
+	if r == nil {
+		return
+	}
+	r.record(r.tagsCtx, busyInvokersM.M(int64(busy)), idleInvokersM.M(int64(idle)))
+}
+
+// Shutdown flushes the OpenTelemetry metrics exporter.
+func (r *EventProcessingStatsReporter) Shutdown(ctx context.Context) error {
+	if r == nil {
+		return nil
+	}
+	return r.otel.shutdown(ctx)
 }
 
 // StatsExporter registers metric views and starts the exporter.
@@ -158,7 +446,10 @@ func StatsExporter() (*EventProcessingStatsReporter, error) {
 		return nil, fmt.Errorf("cannot process metrics env variables: %w", err)
 	}
 
-	registerEventProcessingStatsView()
+	views := append(eventProcessingStatsViews(), invocationStatsViews()...)
+	if err := view.Register(views...); err != nil {
+		return nil, fmt.Errorf("cannot register metric views: %w", err)
+	}
 
 	ctx, err := tag.New(context.Background(),
 		tag.Insert(tagKeyResourceGroup, env.ResourceGroup),
@@ -169,11 +460,37 @@ func StatsExporter() (*EventProcessingStatsReporter, error) {
 		return nil, fmt.Errorf("error creating OpenCensus tags: %w", err)
 	}
 
+	r := &EventProcessingStatsReporter{
+		tagsCtx: ctx,
+	}
+	for _, exporter := range env.Exporters {
+		switch strings.ToLower(strings.TrimSpace(exporter)) {
+		case "prometheus":
+			if err := startPrometheus(env); err != nil {
+				return nil, err
+			}
+		case "otlp":
+			protocol := env.OTLPProtocol
+			if protocol == "" {
+				protocol = env.Protocol
+			}
+			if r.otel, err = newOTelInstruments(protocol, serviceName(env), views); err != nil {
+				return nil, fmt.Errorf("failed to create the OTLP metrics exporter: %w", err)
+			}
+		case "none", "":
+		default:
+			return nil, fmt.Errorf("unknown metrics exporter %q", exporter)
+		}
+	}
+	return r, nil
+}
+
+func startPrometheus(env env) error {
 	pe, err := prometheus.NewExporter(prometheus.Options{
 		Namespace: env.Component,
 	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to create the Prometheus stats exporter: %w", err)
+		return fmt.Errorf("failed to create the Prometheus stats exporter: %w", err)
 	}
 	go func() {
 		metricsExporter := http.NewServeMux()
@@ -182,8 +499,14 @@ func StatsExporter() (*EventProcessingStatsReporter, error) {
 			panic(err)
 		}
 	}()
+	return nil
+}
 
-	return &EventProcessingStatsReporter{
-		tagsCtx: ctx,
-	}, nil
+// serviceName returns the default OpenTelemetry service name,
+// OTEL_SERVICE_NAME takes precedence over it.
+func serviceName(env env) string {
+	if env.Name != "" {
+		return env.Name
+	}
+	return env.Component
 }
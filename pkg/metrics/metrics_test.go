@@ -0,0 +1,26 @@
+package metrics
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestNilReporter(t *testing.T) {
+	var r *EventProcessingStatsReporter
+
+	r.ReportProcessingSuccess()
+	r.ReportProcessingError(true)
+	r.ReportProcessingLatency(time.Second)
+	r.ReportDeliveryAttempt(200)
+	r.ReportDeliveryFailure(false)
+	r.ReportInitDuration(0, time.Second)
+	r.ReportInvocation(time.Second, true)
+	r.ReportQueueWait(time.Second)
+	r.ReportTimeout()
+	r.ReportQueueDepth(1)
+	r.ReportInvokers(1, 1)
+	if err := r.Shutdown(context.Background()); err != nil {
+		t.Errorf("Got %v shutdown error", err)
+	}
+}
@@ -0,0 +1,160 @@
+/*
+Copyright 2023 Triggermesh Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"context"
+	"fmt"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+const instrumentationName = "github.com/triggermesh/aws-custom-runtime/pkg/metrics"
+
+// otelInstruments mirror the OpenCensus measurements to the OpenTelemetry
+// instruments created after the registered views, so that both pipelines
+// export the same metrics.
+type otelInstruments struct {
+	provider    *sdkmetric.MeterProvider
+	instruments map[string]*otelInstrument
+}
+
+type otelInstrument struct {
+	tagKeys   []tag.Key
+	counter   metric.Int64Counter
+	histogram metric.Int64Histogram
+	gauge     metric.Int64Gauge
+}
+
+// newOTelInstruments creates the meter provider with the OTLP exporter.
+// Exporter settings, e.g. the endpoint and headers, and the export
+// interval are read from the standard OTEL_* env variables.
+func newOTelInstruments(protocol, service string, views []*view.View) (*otelInstruments, error) {
+	ctx := context.Background()
+
+	var exporter sdkmetric.Exporter
+	var err error
+	switch protocol {
+	case "grpc":
+		exporter, err = otlpmetricgrpc.New(ctx)
+	case "http/protobuf":
+		exporter, err = otlpmetrichttp.New(ctx)
+	default:
+		return nil, fmt.Errorf("unsupported OTLP protocol %q", protocol)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName(service)),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create resource: %w", err)
+	}
+
+	provider := sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exporter)),
+		sdkmetric.WithResource(res),
+	)
+	return newInstruments(provider, views)
+}
+
+func newInstruments(provider *sdkmetric.MeterProvider, views []*view.View) (*otelInstruments, error) {
+	meter := provider.Meter(instrumentationName)
+	o := &otelInstruments{
+		provider:    provider,
+		instruments: make(map[string]*otelInstrument, len(views)),
+	}
+	for _, v := range views {
+		name := v.Measure.Name()
+		i := &otelInstrument{tagKeys: v.TagKeys}
+		var err error
+		switch v.Aggregation.Type {
+		case view.AggTypeCount:
+			i.counter, err = meter.Int64Counter(name,
+				metric.WithDescription(v.Description),
+				metric.WithUnit(v.Measure.Unit()))
+		case view.AggTypeDistribution:
+			i.histogram, err = meter.Int64Histogram(name,
+				metric.WithDescription(v.Description),
+				metric.WithUnit(v.Measure.Unit()),
+				metric.WithExplicitBucketBoundaries(v.Aggregation.Buckets...))
+		case view.AggTypeLastValue:
+			i.gauge, err = meter.Int64Gauge(name,
+				metric.WithDescription(v.Description),
+				metric.WithUnit(v.Measure.Unit()))
+		default:
+			err = fmt.Errorf("unsupported aggregation %s", v.Aggregation.Type)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot create %q instrument: %w", name, err)
+		}
+		o.instruments[name] = i
+	}
+	return o, nil
+}
+
+// shutdown exports the last collected metrics and stops the meter provider.
+func (o *otelInstruments) shutdown(ctx context.Context) error {
+	if o == nil {
+		return nil
+	}
+	return o.provider.Shutdown(ctx)
+}
+
+// record converts the OpenCensus tags of the view into the attributes
+// and records the measurements. Nil instruments do not record anything.
+func (o *otelInstruments) record(tagsCtx context.Context, ms ...stats.Measurement) {
+	if o == nil {
+		return
+	}
+	tags := tag.FromContext(tagsCtx)
+	for _, m := range ms {
+		i, exists := o.instruments[m.Measure().Name()]
+		if !exists {
+			continue
+		}
+		attributes := make([]attribute.KeyValue, 0, len(i.tagKeys))
+		for _, k := range i.tagKeys {
+			if value, ok := tags.Value(k); ok {
+				attributes = append(attributes, attribute.String(k.Name(), value))
+			}
+		}
+		opt := metric.WithAttributes(attributes...)
+
+		switch {
+		case i.counter != nil:
+			i.counter.Add(tagsCtx, 1, opt)
+		case i.histogram != nil:
+			i.histogram.Record(tagsCtx, int64(m.Value()), opt)
+		case i.gauge != nil:
+			i.gauge.Record(tagsCtx, int64(m.Value()), opt)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package metrics
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opencensus.io/tag"
+	collectormetrics "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// collector is the in-process stand-in of the OTLP/HTTP collector.
+type collector struct {
+	mu      sync.Mutex
+	metrics map[string]map[string]string
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var req collectormetrics.ExportMetricsServiceRequest
+	if err := proto.Unmarshal(body, &req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, rm := range req.ResourceMetrics {
+		for _, sm := range rm.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				attributes := make(map[string]string)
+				if sum := m.GetSum(); sum != nil && len(sum.DataPoints) > 0 {
+					for _, a := range sum.DataPoints[0].Attributes {
+						attributes[a.Key] = a.Value.GetStringValue()
+					}
+				}
+				c.metrics[m.Name] = attributes
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.WriteHeader(http.StatusOK)
+}
+
+func TestOTLPExporter(t *testing.T) {
+	c := &collector{metrics: make(map[string]map[string]string)}
+	server := httptest.NewServer(c)
+	defer server.Close()
+
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", server.URL)
+	t.Setenv("OTEL_METRICS_EXPORTER", "otlp")
+	t.Setenv("NAME", "foo")
+
+	r, err := StatsExporter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.otel == nil {
+		t.Fatal("OTLP exporter is not enabled")
+	}
+
+	r.ReportProcessingSuccess(tag.Insert(tagKeyEventType, "test.type"))
+	r.ReportProcessingLatency(20 * time.Millisecond)
+	r.ReportQueueDepth(3)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := r.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, name := range []string{
+		metricNameEventProcessingSuccessCount,
+		metricNameEventProcessingLatencies,
+		metricNameQueueDepth,
+	} {
+		if _, exists := c.metrics[name]; !exists {
+			t.Errorf("Collector did not receive %q metric", name)
+		}
+	}
+	success := c.metrics[metricNameEventProcessingSuccessCount]
+	if success["event_type"] != "test.type" || success["name"] != "foo" {
+		t.Errorf("Got %v success count attributes", success)
+	}
+}
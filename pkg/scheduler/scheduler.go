@@ -0,0 +1,189 @@
+/*
+Copyright 2023 Triggermesh Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/kelseyhightower/envconfig"
+	"github.com/robfig/cron/v3"
+	"go.uber.org/zap"
+
+	"github.com/triggermesh/aws-custom-runtime/pkg/lambda"
+)
+
+// Scheduled Event constant attributes.
+const (
+	eventSource     = "aws.events"
+	eventDetailType = "Scheduled Event"
+	eventVersion    = "0"
+)
+
+var (
+	rateExpression    = regexp.MustCompile(`^rate\((\d+)\s+(minutes?|hours?|days?)\)$`)
+	cronExpression    = regexp.MustCompile(`^cron\((.+)\)$`)
+	dayOfWeekNumber   = regexp.MustCompile(`(^|[,-])([1-7])`)
+	rateUnitDurations = map[string]time.Duration{
+		"minute": time.Minute,
+		"hour":   time.Hour,
+		"day":    24 * time.Hour,
+	}
+)
+
+// ScheduledEvent is the payload AWS EventBridge sends to the functions
+// triggered by schedule rules.
+type ScheduledEvent struct {
+	Version    string          `json:"version"`
+	ID         string          `json:"id"`
+	DetailType string          `json:"detail-type"`
+	Source     string          `json:"source"`
+	Account    string          `json:"account"`
+	Time       string          `json:"time"`
+	Region     string          `json:"region"`
+	Resources  []string        `json:"resources"`
+	Detail     json.RawMessage `json:"detail"`
+}
+
+// Scheduler invokes the function on schedule, independently of the
+// external API requests.
+type Scheduler struct {
+	// RuleName is used to compose the rule ARN in the event resources.
+	RuleName string `envconfig:"rule_name" default:"custom-runtime-schedule"`
+	// Detail is the JSON object passed in the event "detail" field.
+	Detail string `envconfig:"detail" default:"{}"`
+
+	schedule cron.Schedule
+	invoke   lambda.Invoke
+	logger   *zap.SugaredLogger
+}
+
+// New parses schedule expression and returns the Scheduler instance.
+// Supported expressions are AWS "rate(...)" and "cron(...)" formats
+// as well as the standard 5-fields cron specification.
+func New(expression string, invoke lambda.Invoke, logger *zap.SugaredLogger) (*Scheduler, error) {
+	s := Scheduler{
+		invoke: invoke,
+		logger: logger,
+	}
+	if err := envconfig.Process("schedule", &s); err != nil {
+		return nil, fmt.Errorf("cannot process scheduler env variables: %w", err)
+	}
+	if !json.Valid([]byte(s.Detail)) {
+		return nil, fmt.Errorf("schedule detail is not a valid JSON: %q", s.Detail)
+	}
+
+	schedule, err := parse(expression)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse schedule expression %q: %w", expression, err)
+	}
+	s.schedule = schedule
+	return &s, nil
+}
+
+// Run blocks and invokes the function each time the schedule fires
+// until the context is done.
+func (s *Scheduler) Run(ctx context.Context) {
+	for {
+		next := s.schedule.Next(time.Now())
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+			go s.fire(ctx, next)
+		}
+	}
+}
+
+func (s *Scheduler) fire(ctx context.Context, t time.Time) {
+	event, err := s.event(t)
+	if err != nil {
+		s.logger.Errorf("Cannot create scheduled event: %v", err)
+		return
+	}
+	s.logger.Debugf("Invoking scheduled event: %s", string(event))
+	response, statusCode := s.invoke(ctx, event)
+	if statusCode >= 300 {
+		s.logger.Errorf("Scheduled invocation failed with status %d: %s", statusCode, string(response))
+		return
+	}
+	s.logger.Debugf("Scheduled invocation result: %s", string(response))
+}
+
+func (s *Scheduler) event(t time.Time) ([]byte, error) {
+	return json.Marshal(ScheduledEvent{
+		Version:    eventVersion,
+		ID:         uuid.NewString(),
+		DetailType: eventDetailType,
+		Source:     eventSource,
+		Account:    lambda.Account,
+		Time:       t.UTC().Format(time.RFC3339),
+		Region:     lambda.Region,
+		Resources:  []string{fmt.Sprintf("arn:aws:events:%s:%s:rule/%s", lambda.Region, lambda.Account, s.RuleName)},
+		Detail:     json.RawMessage(s.Detail),
+	})
+}
+
+func parse(expression string) (cron.Schedule, error) {
+	expression = strings.TrimSpace(expression)
+
+	if match := rateExpression.FindStringSubmatch(expression); match != nil {
+		value, err := strconv.Atoi(match[1])
+		if err != nil {
+			return nil, err
+		}
+		if value <= 0 {
+			return nil, fmt.Errorf("rate value must be positive")
+		}
+		return cron.Every(time.Duration(value) * rateUnitDurations[strings.TrimSuffix(match[2], "s")]), nil
+	}
+
+	if match := cronExpression.FindStringSubmatch(expression); match != nil {
+		standard, err := awsCronToStandard(match[1])
+		if err != nil {
+			return nil, err
+		}
+		// AWS evaluates cron expressions in UTC
+		expression = "CRON_TZ=UTC " + standard
+	}
+	return cron.ParseStandard(expression)
+}
+
+// awsCronToStandard converts AWS 6-fields cron expression into the
+// standard 5-fields format. AWS numbers the days of week from 1 (Sunday)
+// to 7 and has an extra year field which only accepts wildcards here.
+func awsCronToStandard(expression string) (string, error) {
+	fields := strings.Fields(expression)
+	if len(fields) != 6 {
+		return "", fmt.Errorf("expected 6 fields, found %d", len(fields))
+	}
+	if year := fields[5]; year != "*" && year != "?" {
+		return "", fmt.Errorf("year field %q is not supported", year)
+	}
+	fields[4] = dayOfWeekNumber.ReplaceAllStringFunc(fields[4], func(s string) string {
+		return s[:len(s)-1] + string(s[len(s)-1]-1)
+	})
+	return strings.Join(fields[:5], " "), nil
+}
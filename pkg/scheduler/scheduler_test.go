@@ -0,0 +1,109 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	// 08:30 UTC
+	now := time.Date(2023, time.March, 1, 10, 30, 0, 0, time.FixedZone("EET", 2*60*60))
+
+	tests := []struct {
+		name       string
+		expression string
+		expected   time.Time
+		wantErr    bool
+	}{
+		{
+			name:       "Rate in minutes",
+			expression: "rate(5 minutes)",
+			expected:   now.Add(5 * time.Minute),
+		},
+		{
+			name:       "Rate of a single day",
+			expression: "rate(1 day)",
+			expected:   now.Add(24 * time.Hour),
+		},
+		{
+			name:       "Zero rate",
+			expression: "rate(0 hours)",
+			wantErr:    true,
+		},
+		{
+			name:       "AWS cron",
+			expression: "cron(0 12 * * ? *)",
+			expected:   time.Date(2023, time.March, 1, 12, 0, 0, 0, time.UTC),
+		},
+		{
+			name:       "AWS cron with days of week",
+			expression: "cron(0 8 ? * 2-6 *)",
+			expected:   time.Date(2023, time.March, 2, 8, 0, 0, 0, time.UTC),
+		},
+		{
+			name:       "AWS cron with year",
+			expression: "cron(0 12 * * ? 2024)",
+			wantErr:    true,
+		},
+		{
+			name:       "Standard cron",
+			expression: "*/15 * * * *",
+			expected:   now.Add(15 * time.Minute),
+		},
+		{
+			name:       "Invalid expression",
+			expression: "every minute",
+			wantErr:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schedule, err := parse(tt.expression)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parse() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				return
+			}
+			if next := schedule.Next(now); !next.Equal(tt.expected) {
+				t.Errorf("Next() got = %v, want %v", next, tt.expected)
+			}
+		})
+	}
+}
+
+func TestEvent(t *testing.T) {
+	s := &Scheduler{
+		RuleName: "test-rule",
+		Detail:   `{"foo":"bar"}`,
+	}
+
+	data, err := s.event(time.Date(2023, time.March, 1, 10, 30, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var event ScheduledEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		t.Fatal(err)
+	}
+
+	if event.Source != "aws.events" || event.DetailType != "Scheduled Event" {
+		t.Errorf("Got %q source and %q detail type", event.Source, event.DetailType)
+	}
+	if event.Time != "2023-03-01T10:30:00Z" {
+		t.Errorf("Got %q time, expecting %q", event.Time, "2023-03-01T10:30:00Z")
+	}
+	if len(event.Resources) != 1 || event.Resources[0] != "arn:aws:events:us-east-1:123456789012:rule/test-rule" {
+		t.Errorf("Got %v resources", event.Resources)
+	}
+	if string(event.Detail) != `{"foo":"bar"}` {
+		t.Errorf("Got %s detail, expecting %s", event.Detail, `{"foo":"bar"}`)
+	}
+	if event.ID == "" {
+		t.Error("Event ID is empty")
+	}
+}
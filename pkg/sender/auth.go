@@ -0,0 +1,271 @@
+/*
+Copyright 2023 Triggermesh Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sender
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kubernetes service account credentials mounted into the pod.
+const (
+	serviceAccountDir     = "/var/run/secrets/kubernetes.io/serviceaccount"
+	oidcTokenExpiration   = 3600
+	oidcTokenRefreshRatio = 0.8
+)
+
+// Auth configures the authentication and TLS of the sink requests.
+type Auth struct {
+	// CAFile is the PEM bundle of the CAs trusted in addition to the system ones
+	CAFile string `envconfig:"ca_file"`
+	// CertFile and KeyFile are the client certificate and key for mutual TLS
+	CertFile string `envconfig:"cert_file"`
+	KeyFile  string `envconfig:"key_file"`
+	// Token is the static bearer token
+	Token string `envconfig:"token"`
+	// TokenFile is the bearer token file, re-read when it changes
+	TokenFile string `envconfig:"token_file"`
+	// Audience enables OIDC tokens of the given audience issued
+	// for the ServiceAccount by the Kubernetes TokenRequest API
+	Audience       string `envconfig:"audience"`
+	ServiceAccount string `envconfig:"service_account"`
+	// Headers are added to every K_SINK request
+	Headers map[string]string `envconfig:"headers"`
+}
+
+// tokenSource returns the bearer token for the sink request.
+type tokenSource interface {
+	token() (string, error)
+}
+
+// authenticator sets the credentials and the extra headers of the K_SINK requests.
+type authenticator struct {
+	headers map[string]string
+	tokens  tokenSource
+}
+
+func newAuthenticator(auth Auth) (*authenticator, error) {
+	a := &authenticator{
+		headers: auth.Headers,
+	}
+	switch {
+	case auth.Audience != "":
+		tokens, err := newOIDCToken(auth.Audience, auth.ServiceAccount)
+		if err != nil {
+			return nil, err
+		}
+		a.tokens = tokens
+	case auth.TokenFile != "":
+		a.tokens = &fileToken{path: auth.TokenFile}
+	case auth.Token != "":
+		a.tokens = staticToken(auth.Token)
+	}
+	return a, nil
+}
+
+func (a *authenticator) apply(req *http.Request) error {
+	for k, v := range a.headers {
+		req.Header.Set(k, v)
+	}
+	if a.tokens == nil {
+		return nil
+	}
+	token, err := a.tokens.token()
+	if err != nil {
+		return fmt.Errorf("cannot get sink token: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// newClient returns the HTTP client with the configured CAs and client certificate.
+func newClient(auth Auth) (*http.Client, error) {
+	if auth.CAFile == "" && auth.CertFile == "" {
+		return http.DefaultClient, nil
+	}
+
+	config := &tls.Config{}
+	if auth.CAFile != "" {
+		pool, err := certPool(auth.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if auth.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(auth.CertFile, auth.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	return &http.Client{Transport: transport}, nil
+}
+
+// certPool adds the PEM bundle to the system CAs.
+func certPool(caFile string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read CA bundle: %w", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %q", caFile)
+	}
+	return pool, nil
+}
+
+type staticToken string
+
+func (t staticToken) token() (string, error) {
+	return string(t), nil
+}
+
+// fileToken reads the token from the file and reloads it when the file
+// is modified, e.g. when the projected volume token is rotated.
+type fileToken struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	value   string
+}
+
+func (t *fileToken) token() (string, error) {
+	info, err := os.Stat(t.path)
+	if err != nil {
+		return "", err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if info.ModTime().Equal(t.modTime) && t.value != "" {
+		return t.value, nil
+	}
+	data, err := ioutil.ReadFile(t.path)
+	if err != nil {
+		return "", err
+	}
+	t.value = strings.TrimSpace(string(data))
+	t.modTime = info.ModTime()
+	return t.value, nil
+}
+
+// oidcToken requests the ServiceAccount tokens of the audience
+// from the Kubernetes API and refreshes them before expiration.
+type oidcToken struct {
+	audience string
+	url      string
+	client   *http.Client
+	// credentials of the runtime pod to call the Kubernetes API
+	credentials tokenSource
+
+	mu      sync.Mutex
+	value   string
+	refresh time.Time
+}
+
+func newOIDCToken(audience, serviceAccount string) (*oidcToken, error) {
+	if serviceAccount == "" {
+		return nil, fmt.Errorf("service account must be set for the OIDC audience tokens")
+	}
+	namespace, err := ioutil.ReadFile(serviceAccountDir + "/namespace")
+	if err != nil {
+		return nil, fmt.Errorf("cannot read pod namespace: %w", err)
+	}
+	client, err := newClient(Auth{CAFile: serviceAccountDir + "/ca.crt"})
+	if err != nil {
+		return nil, err
+	}
+	host := net.JoinHostPort(os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT"))
+	return &oidcToken{
+		audience: audience,
+		url: fmt.Sprintf("https://%s/api/v1/namespaces/%s/serviceaccounts/%s/token",
+			host, strings.TrimSpace(string(namespace)), serviceAccount),
+		client:      client,
+		credentials: &fileToken{path: serviceAccountDir + "/token"},
+	}, nil
+}
+
+func (t *oidcToken) token() (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.value != "" && time.Now().Before(t.refresh) {
+		return t.value, nil
+	}
+
+	credentials, err := t.credentials.token()
+	if err != nil {
+		return "", fmt.Errorf("cannot read service account token: %w", err)
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"apiVersion": "authentication.k8s.io/v1",
+		"kind":       "TokenRequest",
+		"spec": map[string]interface{}{
+			"audiences":         []string{t.audience},
+			"expirationSeconds": oidcTokenExpiration,
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest(http.MethodPost, t.url, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+credentials)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("token request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token request responded with %d status", resp.StatusCode)
+	}
+
+	var tokenRequest struct {
+		Status struct {
+			Token               string    `json:"token"`
+			ExpirationTimestamp time.Time `json:"expirationTimestamp"`
+		} `json:"status"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenRequest); err != nil {
+		return "", fmt.Errorf("cannot decode token response: %w", err)
+	}
+	issued := time.Now()
+	lifetime := tokenRequest.Status.ExpirationTimestamp.Sub(issued)
+	t.value = tokenRequest.Status.Token
+	t.refresh = issued.Add(time.Duration(float64(lifetime) * oidcTokenRefreshRatio))
+	return t.value, nil
+}
@@ -0,0 +1,125 @@
+package sender
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAuthenticatorApply(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("first\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := newAuthenticator(Auth{
+		Token:     "static",
+		TokenFile: tokenFile,
+		Headers:   map[string]string{"X-Api-Key": "foo"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	if err := a.apply(req); err != nil {
+		t.Fatal(err)
+	}
+	if auth := req.Header.Get("Authorization"); auth != "Bearer first" {
+		t.Errorf("Got %q authorization, want %q", auth, "Bearer first")
+	}
+	if key := req.Header.Get("X-Api-Key"); key != "foo" {
+		t.Errorf("Got %q header, want %q", key, "foo")
+	}
+
+	// token file is rotated
+	if err := ioutil.WriteFile(tokenFile, []byte("second"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(tokenFile, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.apply(req); err != nil {
+		t.Fatal(err)
+	}
+	if auth := req.Header.Get("Authorization"); auth != "Bearer second" {
+		t.Errorf("Got %q authorization after rotation, want %q", auth, "Bearer second")
+	}
+}
+
+func TestOIDCToken(t *testing.T) {
+	var requests int
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if auth := r.Header.Get("Authorization"); auth != "Bearer pod-token" {
+			t.Errorf("Got %q token request authorization", auth)
+		}
+		var tokenRequest struct {
+			Spec struct {
+				Audiences []string `json:"audiences"`
+			} `json:"spec"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&tokenRequest); err != nil {
+			t.Fatal(err)
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": map[string]interface{}{
+				"token":               "aud-token-" + tokenRequest.Spec.Audiences[0],
+				"expirationTimestamp": time.Now().Add(time.Hour).Format(time.RFC3339),
+			},
+		})
+	}))
+	defer api.Close()
+
+	source := &oidcToken{
+		audience:    "broker",
+		url:         api.URL,
+		client:      http.DefaultClient,
+		credentials: staticToken("pod-token"),
+	}
+	for i := 0; i < 2; i++ {
+		token, err := source.token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "aud-token-broker" {
+			t.Errorf("Got %q token, want %q", token, "aud-token-broker")
+		}
+	}
+	if requests != 1 {
+		t.Errorf("Got %d token requests, want cached token", requests)
+	}
+}
+
+func TestNewClientCA(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, ca, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := newClient(Auth{CAFile: caFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Request with the custom CA failed: %v", err)
+	}
+	resp.Body.Close()
+
+	if _, err := http.DefaultClient.Get(server.URL); err == nil {
+		t.Error("Request without the custom CA expected to fail")
+	}
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2023 Triggermesh Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sender
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+
+	"github.com/triggermesh/aws-custom-runtime/pkg/converter"
+)
+
+// kafkaTransport produces messages to the topic following the CloudEvents
+// Kafka protocol binding. Sink URL format is "kafka://broker1,broker2/topic".
+type kafkaTransport struct {
+	writer *kafka.Writer
+}
+
+func newKafkaTransport(u *url.URL) (transport, error) {
+	name, err := topic(u)
+	if err != nil {
+		return nil, err
+	}
+	return &kafkaTransport{
+		writer: &kafka.Writer{
+			Addr:         kafka.TCP(strings.Split(u.Host, ",")...),
+			Topic:        name,
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireAll,
+			BatchTimeout: 10 * time.Millisecond,
+		},
+	}, nil
+}
+
+func (t *kafkaTransport) send(ctx context.Context, message *converter.Response) error {
+	return t.writer.WriteMessages(ctx, kafkaMessage(newEnvelope(ctx, message)))
+}
+
+func kafkaMessage(e envelope) kafka.Message {
+	m := kafka.Message{
+		Value: e.body,
+	}
+	if e.contentType != "" {
+		m.Headers = append(m.Headers, kafka.Header{Key: "content-type", Value: []byte(e.contentType)})
+	}
+	for name, value := range e.attributes {
+		m.Headers = append(m.Headers, kafka.Header{Key: "ce_" + name, Value: []byte(value)})
+	}
+	for name, value := range e.trace {
+		m.Headers = append(m.Headers, kafka.Header{Key: name, Value: []byte(value)})
+	}
+	// partitionkey extension is the Kafka message key
+	if key := e.attributes["partitionkey"]; key != "" {
+		m.Key = []byte(key)
+	}
+	return m
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2023 Triggermesh Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sender
+
+import (
+	"context"
+	"net/url"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/triggermesh/aws-custom-runtime/pkg/converter"
+)
+
+// natsTransport publishes messages to the subject following the CloudEvents
+// NATS protocol binding. Sink URL format is "nats://host:4222/subject".
+type natsTransport struct {
+	server  string
+	subject string
+
+	mu   sync.Mutex
+	conn *nats.Conn
+}
+
+func newNATSTransport(u *url.URL) (transport, error) {
+	subject, err := topic(u)
+	if err != nil {
+		return nil, err
+	}
+	server := *u
+	server.Path = ""
+	return &natsTransport{
+		server:  server.String(),
+		subject: subject,
+	}, nil
+}
+
+func (t *natsTransport) send(ctx context.Context, message *converter.Response) error {
+	conn, err := t.connection()
+	if err != nil {
+		return err
+	}
+	if err := conn.PublishMsg(natsMessage(t.subject, newEnvelope(ctx, message))); err != nil {
+		return err
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		return conn.Flush()
+	}
+	return conn.FlushWithContext(ctx)
+}
+
+// connection connects to the server on the first use.
+func (t *natsTransport) connection() (*nats.Conn, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conn != nil && !t.conn.IsClosed() {
+		return t.conn, nil
+	}
+	conn, err := nats.Connect(t.server)
+	if err != nil {
+		return nil, err
+	}
+	t.conn = conn
+	return conn, nil
+}
+
+func natsMessage(subject string, e envelope) *nats.Msg {
+	m := nats.NewMsg(subject)
+	m.Data = e.body
+	if e.contentType != "" {
+		m.Header.Set("Content-Type", e.contentType)
+	}
+	for name, value := range e.attributes {
+		m.Header.Set("ce-"+name, value)
+	}
+	for name, value := range e.trace {
+		m.Header.Set(name, value)
+	}
+	return m
+}
@@ -0,0 +1,155 @@
+/*
+Copyright 2023 Triggermesh Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sender
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/triggermesh/aws-custom-runtime/pkg/converter"
+)
+
+const structuredContentType = "application/cloudevents+json"
+
+var statusPattern = regexp.MustCompile(`^[1-5][0-9x]{2}$`)
+
+// Routes select the sinks by the message content. Type routes are matched
+// first, then the status routes and the error sink. Messages that match
+// none of the routes are sent to the default sink.
+type Routes struct {
+	// Types maps CloudEvent type patterns, e.g. "audit.*", to the sinks
+	Types map[string]string `envconfig:"type_routes"`
+	// Statuses maps response status codes or classes, e.g. "404" or "5xx", to the sinks
+	Statuses map[string]string `envconfig:"status_routes"`
+	// Error is the sink for the function and runtime errors
+	Error string `envconfig:"error"`
+}
+
+type rule struct {
+	pattern string
+	target  string
+}
+
+// router holds the routes sorted by their precedence.
+type router struct {
+	types    []rule
+	statuses []rule
+	errors   string
+	fallback string
+}
+
+func newRouter(routes Routes, fallback string) (*router, error) {
+	// responses are sent to the caller if there is no default sink
+	if fallback == "" && (len(routes.Types) != 0 || len(routes.Statuses) != 0 || routes.Error != "") {
+		return nil, fmt.Errorf("routes require the default sink, K_SINK is not set")
+	}
+	r := &router{
+		errors:   routes.Error,
+		fallback: fallback,
+	}
+	for pattern, target := range routes.Types {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid event type pattern %q: %w", pattern, err)
+		}
+		r.types = append(r.types, rule{pattern: pattern, target: target})
+	}
+	for pattern, target := range routes.Statuses {
+		pattern = strings.ToLower(pattern)
+		if !statusPattern.MatchString(pattern) {
+			return nil, fmt.Errorf("invalid status pattern %q", pattern)
+		}
+		r.statuses = append(r.statuses, rule{pattern: pattern, target: target})
+	}
+	// the longest type pattern and the most specific status take precedence
+	sort.Slice(r.types, func(i, j int) bool {
+		return len(r.types[i].pattern) > len(r.types[j].pattern)
+	})
+	sort.Slice(r.statuses, func(i, j int) bool {
+		return strings.Count(r.statuses[i].pattern, "x") < strings.Count(r.statuses[j].pattern, "x")
+	})
+	return r, nil
+}
+
+// target returns the sink for the message.
+func (r *router) target(message *converter.Response) string {
+	if eventType := eventType(message); eventType != "" {
+		for _, t := range r.types {
+			if matched, _ := path.Match(t.pattern, eventType); matched {
+				return t.target
+			}
+		}
+	}
+	statusCode := message.StatusCode
+	if statusCode == 0 {
+		statusCode = http.StatusOK
+	}
+	status := strconv.Itoa(statusCode)
+	for _, s := range r.statuses {
+		if matchStatus(s.pattern, status) {
+			return s.target
+		}
+	}
+	if r.errors != "" && statusCode >= http.StatusBadRequest {
+		return r.errors
+	}
+	return r.fallback
+}
+
+// targets returns all sinks referenced by the routes.
+func (r *router) targets() []string {
+	targets := []string{r.fallback, r.errors}
+	for _, t := range r.types {
+		targets = append(targets, t.target)
+	}
+	for _, s := range r.statuses {
+		targets = append(targets, s.target)
+	}
+	return targets
+}
+
+func matchStatus(pattern, status string) bool {
+	if len(pattern) != len(status) {
+		return false
+	}
+	for i := range pattern {
+		if pattern[i] != 'x' && pattern[i] != status[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// eventType reads the CloudEvent type of the binary or structured message.
+func eventType(message *converter.Response) string {
+	if eventType := message.Header.Get("ce-type"); eventType != "" {
+		return eventType
+	}
+	if !strings.HasPrefix(message.Header.Get("Content-Type"), structuredContentType) {
+		return ""
+	}
+	var event struct {
+		Type string `json:"type"`
+	}
+	_ = json.Unmarshal(message.Body, &event)
+	return event.Type
+}
@@ -19,55 +19,267 @@ package sender
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+
+	"github.com/triggermesh/aws-custom-runtime/pkg/converter"
+	"github.com/triggermesh/aws-custom-runtime/pkg/metrics"
+	"github.com/triggermesh/aws-custom-runtime/pkg/tracing"
 )
 
+// ErrNoDeadLetterSink is returned when the dead-letter sink is not configured.
+var ErrNoDeadLetterSink = errors.New("dead-letter sink is not configured")
+
+// Delivery configures the requests to the sinks.
+type Delivery struct {
+	// Retries is the number of repeated attempts after the failed request
+	Retries int `envconfig:"retries" default:"3"`
+	// BackoffDelay is the delay before the first retry, doubled on each next one
+	BackoffDelay time.Duration `envconfig:"backoff_delay" default:"200ms"`
+	// BackoffMax limits the delay between the retries
+	BackoffMax time.Duration `envconfig:"backoff_max" default:"10s"`
+	// Timeout limits the duration of each attempt
+	Timeout time.Duration `envconfig:"timeout" default:"30s"`
+	// Reply returns the sink response status, headers and body to the caller
+	// instead of the function response status
+	Reply bool `envconfig:"reply" default:"false"`
+}
+
 type Sender struct {
-	target      string
-	contentType string
+	target     string
+	deadLetter string
+	delivery   Delivery
+	routes     *router
+	client     *http.Client
+	auth       *authenticator
+	transports map[string]transport
+
+	reporter *metrics.EventProcessingStatsReporter
+	logger   *zap.SugaredLogger
 }
 
-func New(target, contentType string) *Sender {
-	return &Sender{
-		target:      target,
-		contentType: contentType,
+func New(target, deadLetter string, reporter *metrics.EventProcessingStatsReporter, logger *zap.SugaredLogger) (*Sender, error) {
+	s := &Sender{
+		target:     target,
+		deadLetter: deadLetter,
+		reporter:   reporter,
+		logger:     logger,
 	}
-}
+	if err := envconfig.Process("sink", &s.delivery); err != nil {
+		return nil, fmt.Errorf("cannot process sink delivery env variables: %w", err)
+	}
+	var routes Routes
+	if err := envconfig.Process("sink", &routes); err != nil {
+		return nil, fmt.Errorf("cannot process sink routes env variables: %w", err)
+	}
+	router, err := newRouter(routes, target)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create sink routes: %w", err)
+	}
+	s.routes = router
 
-func (h *Sender) Send(data []byte, statusCode int, writer http.ResponseWriter) error {
-	ctx := context.Background()
+	var auth Auth
+	if err := envconfig.Process("sink", &auth); err != nil {
+		return nil, fmt.Errorf("cannot process sink auth env variables: %w", err)
+	}
+	if s.client, err = newClient(auth); err != nil {
+		return nil, fmt.Errorf("cannot create sink client: %w", err)
+	}
+	if s.auth, err = newAuthenticator(auth); err != nil {
+		return nil, fmt.Errorf("cannot create sink authenticator: %w", err)
+	}
+	if s.transports, err = newTransports(append(router.targets(), deadLetter)); err != nil {
+		return nil, fmt.Errorf("cannot create sink transports: %w", err)
+	}
+	return s, nil
+}
 
+// Send delivers the response to the sink or replies it to the caller.
+// Batched responses are delivered to the sink one message at a time,
+// each message goes to the sink selected by the routes.
+// Messages that could not be delivered are sent to the dead-letter sink.
+// In reply mode the caller gets the last sink response.
+func (h *Sender) Send(ctx context.Context, response *converter.Response, writer http.ResponseWriter) error {
 	if h.target != "" {
-		resp, err := h.request(ctx, data)
-		if err != nil {
-			writer.WriteHeader(http.StatusInternalServerError)
-			return fmt.Errorf("failed to send the data: %w", err)
+		messages := response.Parts
+		if len(messages) == 0 {
+			messages = []*converter.Response{response}
 		}
-		body, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			writer.WriteHeader(http.StatusBadGateway)
-			return err
+		var sinkReply *converter.Response
+		for _, message := range messages {
+			if len(message.Body) == 0 && len(message.Header) == 0 {
+				continue
+			}
+			resp, err := h.deliver(ctx, h.routes.target(message), message)
+			if err != nil {
+				if dlErr := h.DeadLetter(ctx, message); dlErr == nil {
+					h.reporter.ReportDeliveryFailure(true)
+					h.logger.Warnf("Message is sent to dead-letter sink: %v", err)
+					continue
+				} else if !errors.Is(dlErr, ErrNoDeadLetterSink) {
+					h.logger.Errorf("Cannot deliver message to dead-letter sink: %v", dlErr)
+				}
+				h.reporter.ReportDeliveryFailure(false)
+				writer.WriteHeader(http.StatusBadGateway)
+				return fmt.Errorf("failed to send the data: %w", err)
+			}
+			sinkReply = resp
 		}
-		writer.WriteHeader(statusCode)
-		// response body may contain useful information,
-		// although it's not clear where we should send it at the moment
-		// writer.Write(body)
-		_ = body
+		if h.delivery.Reply && sinkReply != nil {
+			return h.reply(ctx, sinkReply.Body, sinkReply.Header, sinkReply.StatusCode, writer)
+		}
+		writer.WriteHeader(response.StatusCode)
 		return nil
 	}
 
-	return h.reply(ctx, data, statusCode, writer)
+	return h.reply(ctx, response.Body, response.Header, response.StatusCode, writer)
 }
 
-func (h *Sender) request(ctx context.Context, data []byte) (*http.Response, error) {
-	return http.Post(h.target, h.contentType, bytes.NewBuffer(data))
+// DeadLetter delivers the rejected message to the dead-letter sink.
+func (h *Sender) DeadLetter(ctx context.Context, message *converter.Response) error {
+	if h.deadLetter == "" {
+		return ErrNoDeadLetterSink
+	}
+	if _, err := h.deliver(ctx, h.deadLetter, message); err != nil {
+		return fmt.Errorf("failed to send the data to dead-letter sink: %w", err)
+	}
+	return nil
 }
 
-func (h *Sender) reply(ctx context.Context, data []byte, statusCode int, writer http.ResponseWriter) error {
-	writer.Header().Set("Content-Type", h.contentType)
+// deliver sends the message to the target retrying network errors, throttled
+// and server-side failures. Returned response is the last sink reply.
+func (h *Sender) deliver(ctx context.Context, target string, message *converter.Response) (*converter.Response, error) {
+	ctx, span := tracing.Tracer().Start(ctx, "deliver",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(attribute.String("sink", redacted(target))),
+	)
+	defer span.End()
+
+	for attempt := 0; ; attempt++ {
+		resp, err := h.attempt(ctx, target, message)
+		var statusCode int
+		if resp != nil {
+			statusCode = resp.StatusCode
+		}
+		h.reporter.ReportDeliveryAttempt(statusCode)
+		span.AddEvent("attempt", trace.WithAttributes(attribute.Int("status_code", statusCode)))
+
+		if err == nil && statusCode >= http.StatusBadRequest {
+			err = fmt.Errorf("sink responded with %d status", statusCode)
+		}
+		if err == nil || !retryable(statusCode) || attempt >= h.delivery.Retries {
+			if err != nil {
+				span.SetStatus(codes.Error, err.Error())
+			}
+			return resp, err
+		}
+
+		delay := h.backoff(attempt)
+		h.logger.Debugf("Delivery attempt %d failed, retrying in %s: %v", attempt+1, delay, err)
+		select {
+		case <-ctx.Done():
+			return resp, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// retryable checks if the request with the given response
+// status should be repeated. Zero status is a network error.
+func retryable(statusCode int) bool {
+	return statusCode == 0 ||
+		statusCode == http.StatusTooManyRequests ||
+		statusCode >= http.StatusInternalServerError
+}
+
+// backoff returns the exponential delay before the retry
+// with the random jitter of up to a half of the delay.
+func (h *Sender) backoff(attempt int) time.Duration {
+	delay := h.delivery.BackoffDelay << uint(attempt)
+	if delay <= 0 || delay > h.delivery.BackoffMax {
+		delay = h.delivery.BackoffMax
+	}
+	if half := int64(delay / 2); half > 0 {
+		delay = time.Duration(half + rand.Int63n(half+1))
+	}
+	return delay
+}
+
+// attempt sends the message to the target once. Messages accepted
+// by the non-HTTP transports have the empty 202 reply.
+func (h *Sender) attempt(ctx context.Context, target string, message *converter.Response) (*converter.Response, error) {
+	if h.delivery.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.delivery.Timeout)
+		defer cancel()
+	}
+	if t, exists := h.transports[target]; exists {
+		if err := t.send(ctx, message); err != nil {
+			return nil, err
+		}
+		return &converter.Response{StatusCode: http.StatusAccepted}, nil
+	}
+	return h.post(ctx, target, message.Body, message.Header)
+}
+
+// post makes a single request to the target and reads the reply.
+func (h *Sender) post(ctx context.Context, target string, data []byte, header http.Header) (*converter.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewBuffer(data))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	tracing.Inject(ctx, req.Header)
+	// credentials are not sent to the route and dead-letter sinks,
+	// which may belong to the third parties
+	if target == h.target {
+		if err := h.auth.apply(req); err != nil {
+			return nil, err
+		}
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &converter.Response{
+		Body:       body,
+		Header:     resp.Header,
+		StatusCode: resp.StatusCode,
+	}, nil
+}
+
+func (h *Sender) reply(ctx context.Context, data []byte, header http.Header, statusCode int, writer http.ResponseWriter) error {
+	for k, v := range header {
+		writer.Header()[k] = v
+	}
 	writer.WriteHeader(statusCode)
 	_, err := writer.Write(data)
 	return err
 }
+
+// redacted returns the sink URL without the password.
+func redacted(target string) string {
+	u, err := url.Parse(target)
+	if err != nil {
+		return ""
+	}
+	return u.Redacted()
+}
@@ -0,0 +1,272 @@
+package sender
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/triggermesh/aws-custom-runtime/pkg/converter"
+)
+
+func newTestSender(target, deadLetter string) *Sender {
+	return &Sender{
+		target:     target,
+		deadLetter: deadLetter,
+		routes:     &router{fallback: target},
+		client:     http.DefaultClient,
+		auth:       &authenticator{},
+		delivery: Delivery{
+			Retries:      2,
+			BackoffDelay: time.Millisecond,
+			BackoffMax:   5 * time.Millisecond,
+			Timeout:      time.Second,
+		},
+		logger: zap.NewNop().Sugar(),
+	}
+}
+
+// sink replies with the given statuses in order, repeating the last one.
+func sink(t *testing.T, statuses ...int) (*httptest.Server, *int32) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(atomic.AddInt32(&requests, 1))
+		if n > len(statuses) {
+			n = len(statuses)
+		}
+		w.WriteHeader(statuses[n-1])
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func TestSend(t *testing.T) {
+	tests := []struct {
+		name               string
+		sink               []int
+		deadLetter         []int
+		expectedStatusCode int
+		expectedAttempts   int32
+		expectedDeadLetter int32
+		wantErr            bool
+	}{
+		{
+			name:               "Delivered",
+			sink:               []int{http.StatusAccepted},
+			expectedStatusCode: http.StatusOK,
+			expectedAttempts:   1,
+		},
+		{
+			name:               "Delivered after retries",
+			sink:               []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK},
+			expectedStatusCode: http.StatusOK,
+			expectedAttempts:   3,
+		},
+		{
+			name:               "Retries exhausted",
+			sink:               []int{http.StatusInternalServerError},
+			expectedStatusCode: http.StatusBadGateway,
+			expectedAttempts:   3,
+			wantErr:            true,
+		},
+		{
+			name:               "Client error is not retried",
+			sink:               []int{http.StatusBadRequest},
+			expectedStatusCode: http.StatusBadGateway,
+			expectedAttempts:   1,
+			wantErr:            true,
+		},
+		{
+			name:               "Dead-lettered",
+			sink:               []int{http.StatusInternalServerError},
+			deadLetter:         []int{http.StatusOK},
+			expectedStatusCode: http.StatusOK,
+			expectedAttempts:   3,
+			expectedDeadLetter: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target, attempts := sink(t, tt.sink...)
+			var deadLetterURL string
+			deadLetterAttempts := new(int32)
+			if tt.deadLetter != nil {
+				var deadLetter *httptest.Server
+				deadLetter, deadLetterAttempts = sink(t, tt.deadLetter...)
+				deadLetterURL = deadLetter.URL
+			}
+
+			recorder := httptest.NewRecorder()
+			resp := converter.NewResponse([]byte("foo"), "text/plain")
+			resp.StatusCode = http.StatusOK
+			err := newTestSender(target.URL, deadLetterURL).Send(context.Background(), resp, recorder)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Send() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if recorder.Code != tt.expectedStatusCode {
+				t.Errorf("Got %d status, want %d", recorder.Code, tt.expectedStatusCode)
+			}
+			if *attempts != tt.expectedAttempts {
+				t.Errorf("Got %d delivery attempts, want %d", *attempts, tt.expectedAttempts)
+			}
+			if *deadLetterAttempts != tt.expectedDeadLetter {
+				t.Errorf("Got %d dead-letter attempts, want %d", *deadLetterAttempts, tt.expectedDeadLetter)
+			}
+		})
+	}
+}
+
+func TestSendCredentials(t *testing.T) {
+	authorization := make(chan string, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization <- r.Header.Get("Authorization") + r.Header.Get("X-Api-Key")
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	s := newTestSender(server.URL+"/sink", server.URL+"/dead-letter")
+	s.auth = &authenticator{
+		headers: map[string]string{"X-Api-Key": "foo"},
+		tokens:  staticToken("secret"),
+	}
+	message := &converter.Response{Body: []byte("foo"), StatusCode: http.StatusOK}
+
+	if err := s.Send(context.Background(), message, httptest.NewRecorder()); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-authorization; got != "Bearer secretfoo" {
+		t.Errorf("Got %q sink credentials, want %q", got, "Bearer secretfoo")
+	}
+	if err := s.DeadLetter(context.Background(), message); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-authorization; got != "" {
+		t.Errorf("Got %q dead-letter sink credentials, want none", got)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	s := newTestSender("", "")
+	for attempt, max := range []time.Duration{time.Millisecond, 2 * time.Millisecond, 4 * time.Millisecond, 5 * time.Millisecond, 5 * time.Millisecond} {
+		if delay := s.backoff(attempt); delay < max/2 || delay > max {
+			t.Errorf("Got %s delay for attempt %d, want between %s and %s", delay, attempt, max/2, max)
+		}
+	}
+}
+
+func TestSendReply(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Ce-Type", "reply.type")
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("bar"))
+	}))
+	defer target.Close()
+
+	s := newTestSender(target.URL, "")
+	s.delivery.Reply = true
+
+	recorder := httptest.NewRecorder()
+	resp := converter.NewResponse([]byte("foo"), "text/plain")
+	resp.StatusCode = http.StatusOK
+	if err := s.Send(context.Background(), resp, recorder); err != nil {
+		t.Fatal(err)
+	}
+	if recorder.Code != http.StatusAccepted {
+		t.Errorf("Got %d status, want %d", recorder.Code, http.StatusAccepted)
+	}
+	if body := recorder.Body.String(); body != "bar" {
+		t.Errorf("Got %q body, want %q", body, "bar")
+	}
+	if ceType := recorder.Header().Get("Ce-Type"); ceType != "reply.type" {
+		t.Errorf("Got %q ce-type header, want %q", ceType, "reply.type")
+	}
+}
+
+func TestRouterTarget(t *testing.T) {
+	r, err := newRouter(Routes{
+		Types: map[string]string{
+			"audit.*":       "audit",
+			"audit.login.*": "login",
+		},
+		Statuses: map[string]string{
+			"4xx": "client-errors",
+			"404": "not-found",
+		},
+		Error: "errors",
+	}, "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	binary := func(eventType string, statusCode int) *converter.Response {
+		resp := converter.NewResponse(nil, "application/json")
+		resp.Header.Set("ce-type", eventType)
+		resp.StatusCode = statusCode
+		return resp
+	}
+
+	tests := []struct {
+		name     string
+		message  *converter.Response
+		expected string
+	}{
+		{
+			name:     "Success",
+			message:  binary("com.example", 0),
+			expected: "default",
+		},
+		{
+			name:     "Type pattern",
+			message:  binary("audit.create", http.StatusOK),
+			expected: "audit",
+		},
+		{
+			name:     "Longest type pattern",
+			message:  binary("audit.login.failed", http.StatusOK),
+			expected: "login",
+		},
+		{
+			name:     "Structured event type",
+			message:  converter.NewResponse([]byte(`{"type":"audit.delete"}`), "application/cloudevents+json"),
+			expected: "audit",
+		},
+		{
+			name:     "Exact status",
+			message:  binary("com.example", http.StatusNotFound),
+			expected: "not-found",
+		},
+		{
+			name:     "Status class",
+			message:  binary("com.example", http.StatusBadRequest),
+			expected: "client-errors",
+		},
+		{
+			name:     "Function error",
+			message:  binary("com.example", http.StatusInternalServerError),
+			expected: "errors",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if target := r.target(tt.message); target != tt.expected {
+				t.Errorf("Got %q sink, want %q", target, tt.expected)
+			}
+		})
+	}
+
+	if _, err := newRouter(Routes{Statuses: map[string]string{"2xxx": "foo"}}, "default"); err == nil {
+		t.Error("newRouter() expected error for the invalid status pattern")
+	}
+	if _, err := newRouter(Routes{Error: "errors"}, ""); err == nil {
+		t.Error("newRouter() expected error for the routes without the default sink")
+	}
+	if _, err := newRouter(Routes{}, ""); err != nil {
+		t.Errorf("newRouter() got unexpected error without routes: %v", err)
+	}
+}
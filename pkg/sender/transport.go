@@ -0,0 +1,105 @@
+/*
+Copyright 2023 Triggermesh Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sender
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/triggermesh/aws-custom-runtime/pkg/converter"
+	"github.com/triggermesh/aws-custom-runtime/pkg/tracing"
+)
+
+// transport delivers messages to the non-HTTP sinks.
+type transport interface {
+	send(ctx context.Context, message *converter.Response) error
+}
+
+// newTransport returns the transport selected by the sink URL scheme,
+// or nil for the HTTP sinks.
+func newTransport(target string) (transport, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sink URL %q: %w", target, err)
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "kafka":
+		return newKafkaTransport(u)
+	case "nats":
+		return newNATSTransport(u)
+	case "amqp", "amqps":
+		return newAMQPTransport(u)
+	}
+	return nil, nil
+}
+
+// newTransports creates the transports for the non-HTTP sinks.
+func newTransports(targets []string) (map[string]transport, error) {
+	transports := make(map[string]transport)
+	for _, target := range targets {
+		if _, exists := transports[target]; exists || target == "" {
+			continue
+		}
+		t, err := newTransport(target)
+		if err != nil {
+			return nil, err
+		}
+		if t != nil {
+			transports[target] = t
+		}
+	}
+	return transports, nil
+}
+
+// envelope is the message split into the CloudEvent attributes carried
+// by the binary mode ce-* headers, the content type and the body.
+// Structured events and non-CloudEvents messages have no attributes.
+// Trace context headers of the delivery span, e.g. "traceparent",
+// are passed in the message headers of each protocol as is.
+type envelope struct {
+	contentType string
+	attributes  map[string]string
+	trace       map[string]string
+	body        []byte
+}
+
+func newEnvelope(ctx context.Context, message *converter.Response) envelope {
+	e := envelope{
+		contentType: message.Header.Get("Content-Type"),
+		attributes:  make(map[string]string),
+		trace:       tracing.Carrier(ctx),
+		body:        message.Body,
+	}
+	for k, v := range message.Header {
+		k = strings.ToLower(k)
+		if strings.HasPrefix(k, "ce-") && len(v) != 0 {
+			e.attributes[k[3:]] = v[0]
+		}
+	}
+	return e
+}
+
+// topic returns the URL path as the topic, subject or address name.
+func topic(u *url.URL) (string, error) {
+	name := strings.Trim(u.Path, "/")
+	if name == "" {
+		return "", fmt.Errorf("sink URL %q has no destination in the path", u.Redacted())
+	}
+	return name, nil
+}
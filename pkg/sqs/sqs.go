@@ -0,0 +1,287 @@
+/*
+Copyright 2023 Triggermesh Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sqs
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/kelseyhightower/envconfig"
+	"go.uber.org/zap"
+
+	"github.com/triggermesh/aws-custom-runtime/pkg/lambda"
+)
+
+// SQS event constant attributes.
+const (
+	eventSource = "aws:sqs"
+)
+
+// Event is the payload AWS Lambda receives from the SQS event source.
+type Event struct {
+	Records []Message `json:"Records"`
+}
+
+// Message is the SQS message in the Lambda event format.
+type Message struct {
+	MessageID         string                      `json:"messageId"`
+	ReceiptHandle     string                      `json:"receiptHandle"`
+	Body              string                      `json:"body"`
+	Attributes        map[string]string           `json:"attributes"`
+	MessageAttributes map[string]MessageAttribute `json:"messageAttributes"`
+	MD5OfBody         string                      `json:"md5OfBody"`
+	EventSource       string                      `json:"eventSource"`
+	EventSourceARN    string                      `json:"eventSourceARN"`
+	AWSRegion         string                      `json:"awsRegion"`
+}
+
+// MessageAttribute is the message attribute with base64 encoded binary values.
+type MessageAttribute struct {
+	StringValue      *string  `json:"stringValue,omitempty"`
+	BinaryValue      *string  `json:"binaryValue,omitempty"`
+	StringListValues []string `json:"stringListValues"`
+	BinaryListValues []string `json:"binaryListValues"`
+	DataType         string   `json:"dataType"`
+}
+
+// BatchResponse is the function response that reports failed messages.
+type BatchResponse struct {
+	BatchItemFailures []struct {
+		ItemIdentifier string `json:"itemIdentifier"`
+	} `json:"batchItemFailures"`
+}
+
+// client is the part of the SQS API used by the Poller.
+type client interface {
+	ReceiveMessage(context.Context, *sqs.ReceiveMessageInput, ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error)
+	DeleteMessageBatch(context.Context, *sqs.DeleteMessageBatchInput, ...func(*sqs.Options)) (*sqs.DeleteMessageBatchOutput, error)
+}
+
+// Poller long-polls the SQS-compatible queue and invokes the function with
+// the batches of messages. Messages are deleted after successful invocation,
+// the failed ones are received again when their visibility timeout expires.
+type Poller struct {
+	// Endpoint overrides the SQS API endpoint, e.g. for ElasticMQ or LocalStack.
+	Endpoint string `envconfig:"endpoint"`
+	// Region of the queue.
+	Region string `envconfig:"region" default:"us-east-1"`
+	// BatchSize limits the number of messages in the event, up to 10.
+	BatchSize int64 `envconfig:"batch_size" default:"10"`
+	// WaitTime is the long polling duration, up to 20 seconds.
+	WaitTime time.Duration `envconfig:"wait_time" default:"20s"`
+	// VisibilityTimeout overrides the queue visibility timeout of the received messages.
+	VisibilityTimeout time.Duration `envconfig:"visibility_timeout"`
+	// RetryDelay is the pause after the failed receive request.
+	RetryDelay time.Duration `envconfig:"retry_delay" default:"1s"`
+
+	queueURL string
+	queueARN string
+	client   client
+	invoke   lambda.Invoke
+	logger   *zap.SugaredLogger
+}
+
+// New returns the Poller of the queue.
+func New(queueURL string, invoke lambda.Invoke, logger *zap.SugaredLogger) (*Poller, error) {
+	p := Poller{
+		queueURL: queueURL,
+		invoke:   invoke,
+		logger:   logger,
+	}
+	if err := envconfig.Process("sqs", &p); err != nil {
+		return nil, fmt.Errorf("cannot process SQS poller env variables: %w", err)
+	}
+	if p.BatchSize < 1 || p.BatchSize > 10 {
+		return nil, fmt.Errorf("batch size must be between 1 and 10, got %d", p.BatchSize)
+	}
+	if p.WaitTime < 0 || p.WaitTime > 20*time.Second {
+		return nil, fmt.Errorf("wait time must be between 0 and 20s, got %s", p.WaitTime)
+	}
+	arn, err := queueARN(queueURL, p.Region)
+	if err != nil {
+		return nil, err
+	}
+	p.queueARN = arn
+
+	cfg, err := config.LoadDefaultConfig(context.Background(), config.WithRegion(p.Region))
+	if err != nil {
+		return nil, fmt.Errorf("cannot load AWS config: %w", err)
+	}
+	p.client = sqs.NewFromConfig(cfg, func(o *sqs.Options) {
+		if p.Endpoint != "" {
+			o.BaseEndpoint = aws.String(p.Endpoint)
+		}
+	})
+	return &p, nil
+}
+
+// queueARN composes the queue ARN from its URL, e.g.
+// "https://sqs.us-east-1.amazonaws.com/123456789012/orders".
+func queueARN(queueURL, region string) (string, error) {
+	u, err := url.Parse(queueURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid queue URL %q: %w", queueURL, err)
+	}
+	path := strings.Split(strings.Trim(u.Path, "/"), "/")
+	name := path[len(path)-1]
+	if name == "" {
+		return "", fmt.Errorf("queue URL %q has no queue name", queueURL)
+	}
+	// queue URLs of the SQS-compatible brokers may have no account
+	accountID := lambda.Account
+	if len(path) > 1 && path[0] != "" && path[0] != "queue" {
+		accountID = path[0]
+	}
+	return fmt.Sprintf("arn:aws:sqs:%s:%s:%s", region, accountID, name), nil
+}
+
+// Run polls the queue until the context is done.
+func (p *Poller) Run(ctx context.Context) {
+	for ctx.Err() == nil {
+		if err := p.poll(ctx); err != nil && ctx.Err() == nil {
+			p.logger.Errorf("SQS poller: %v", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(p.RetryDelay):
+			}
+		}
+	}
+}
+
+// poll receives the batch of messages, invokes the function
+// and deletes the messages processed successfully.
+func (p *Poller) poll(ctx context.Context) error {
+	input := &sqs.ReceiveMessageInput{
+		QueueUrl:                    aws.String(p.queueURL),
+		MaxNumberOfMessages:         int32(p.BatchSize),
+		WaitTimeSeconds:             int32(p.WaitTime / time.Second),
+		MessageSystemAttributeNames: []types.MessageSystemAttributeName{types.MessageSystemAttributeNameAll},
+		MessageAttributeNames:       []string{"All"},
+	}
+	if p.VisibilityTimeout > 0 {
+		input.VisibilityTimeout = int32(p.VisibilityTimeout / time.Second)
+	}
+	output, err := p.client.ReceiveMessage(ctx, input)
+	if err != nil {
+		return fmt.Errorf("cannot receive messages: %w", err)
+	}
+	// visibility timeout starts when the long poll returns the messages
+	received := time.Now()
+	if len(output.Messages) == 0 {
+		return nil
+	}
+
+	event, err := json.Marshal(p.event(output.Messages))
+	if err != nil {
+		return fmt.Errorf("cannot encode SQS event: %w", err)
+	}
+	response, statusCode := p.invoke(ctx, event)
+	if statusCode >= http.StatusBadRequest {
+		return fmt.Errorf("function failed with %d status: %s", statusCode, response)
+	}
+	if p.VisibilityTimeout > 0 && time.Since(received) > p.VisibilityTimeout {
+		return fmt.Errorf("invocation exceeded %s visibility timeout, messages are not deleted", p.VisibilityTimeout)
+	}
+
+	failed := failedItems(response)
+	var entries []types.DeleteMessageBatchRequestEntry
+	for i, m := range output.Messages {
+		if failed[aws.ToString(m.MessageId)] {
+			continue
+		}
+		entries = append(entries, types.DeleteMessageBatchRequestEntry{
+			Id:            aws.String(strconv.Itoa(i)),
+			ReceiptHandle: m.ReceiptHandle,
+		})
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	result, err := p.client.DeleteMessageBatch(ctx, &sqs.DeleteMessageBatchInput{
+		QueueUrl: aws.String(p.queueURL),
+		Entries:  entries,
+	})
+	if err != nil {
+		return fmt.Errorf("cannot delete messages: %w", err)
+	}
+	if len(result.Failed) != 0 {
+		return fmt.Errorf("cannot delete %d messages: %s", len(result.Failed), aws.ToString(result.Failed[0].Message))
+	}
+	return nil
+}
+
+func (p *Poller) event(messages []types.Message) Event {
+	e := Event{
+		Records: make([]Message, len(messages)),
+	}
+	for i, m := range messages {
+		e.Records[i] = Message{
+			MessageID:         aws.ToString(m.MessageId),
+			ReceiptHandle:     aws.ToString(m.ReceiptHandle),
+			Body:              aws.ToString(m.Body),
+			Attributes:        m.Attributes,
+			MessageAttributes: make(map[string]MessageAttribute, len(m.MessageAttributes)),
+			MD5OfBody:         aws.ToString(m.MD5OfBody),
+			EventSource:       eventSource,
+			EventSourceARN:    p.queueARN,
+			AWSRegion:         p.Region,
+		}
+		for name, v := range m.MessageAttributes {
+			attribute := MessageAttribute{
+				StringValue:      v.StringValue,
+				StringListValues: v.StringListValues,
+				BinaryListValues: make([]string, len(v.BinaryListValues)),
+				DataType:         aws.ToString(v.DataType),
+			}
+			if attribute.StringListValues == nil {
+				attribute.StringListValues = []string{}
+			}
+			if v.BinaryValue != nil {
+				attribute.BinaryValue = aws.String(base64.StdEncoding.EncodeToString(v.BinaryValue))
+			}
+			for j, b := range v.BinaryListValues {
+				attribute.BinaryListValues[j] = base64.StdEncoding.EncodeToString(b)
+			}
+			e.Records[i].MessageAttributes[name] = attribute
+		}
+	}
+	return e
+}
+
+// failedItems reads the IDs of failed messages from the function response.
+func failedItems(response []byte) map[string]bool {
+	var r BatchResponse
+	if err := json.Unmarshal(response, &r); err != nil {
+		return nil
+	}
+	failed := make(map[string]bool, len(r.BatchItemFailures))
+	for _, f := range r.BatchItemFailures {
+		failed[f.ItemIdentifier] = true
+	}
+	return failed
+}
@@ -0,0 +1,194 @@
+package sqs
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"go.uber.org/zap"
+)
+
+// fakeClient is the in-memory stand-in of the SQS API.
+type fakeClient struct {
+	messages []types.Message
+	deleted  []string
+	// wait is the time the receive request waits for the messages
+	wait  time.Duration
+	input *sqs.ReceiveMessageInput
+}
+
+func (c *fakeClient) ReceiveMessage(ctx context.Context, input *sqs.ReceiveMessageInput, opts ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error) {
+	c.input = input
+	time.Sleep(c.wait)
+	return &sqs.ReceiveMessageOutput{Messages: c.messages}, nil
+}
+
+func (c *fakeClient) DeleteMessageBatch(ctx context.Context, input *sqs.DeleteMessageBatchInput, opts ...func(*sqs.Options)) (*sqs.DeleteMessageBatchOutput, error) {
+	for _, e := range input.Entries {
+		c.deleted = append(c.deleted, aws.ToString(e.ReceiptHandle))
+	}
+	return &sqs.DeleteMessageBatchOutput{}, nil
+}
+
+func messages() []types.Message {
+	return []types.Message{
+		{
+			MessageId:     aws.String("m1"),
+			ReceiptHandle: aws.String("r1"),
+			Body:          aws.String("foo"),
+			Attributes:    map[string]string{"ApproximateReceiveCount": "1"},
+			MessageAttributes: map[string]types.MessageAttributeValue{
+				"kind": {DataType: aws.String("String"), StringValue: aws.String("order")},
+				"blob": {DataType: aws.String("Binary"), BinaryValue: []byte("hi")},
+			},
+		},
+		{MessageId: aws.String("m2"), ReceiptHandle: aws.String("r2"), Body: aws.String("bar")},
+		{MessageId: aws.String("m3"), ReceiptHandle: aws.String("r3"), Body: aws.String("baz")},
+	}
+}
+
+func TestQueueARN(t *testing.T) {
+	tests := map[string]string{
+		"https://sqs.eu-west-1.amazonaws.com/111122223333/orders": "arn:aws:sqs:eu-west-1:111122223333:orders",
+		"http://elasticmq:9324/queue/orders":                      "arn:aws:sqs:eu-west-1:123456789012:orders",
+	}
+	for queueURL, expected := range tests {
+		arn, err := queueARN(queueURL, "eu-west-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if arn != expected {
+			t.Errorf("Got %q ARN for %q, want %q", arn, queueURL, expected)
+		}
+	}
+}
+
+func TestEvent(t *testing.T) {
+	p := &Poller{Region: "us-east-1", queueARN: "arn:aws:sqs:us-east-1:123456789012:orders"}
+
+	data, err := json.Marshal(p.event(messages()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var event Event
+	if err := json.Unmarshal(data, &event); err != nil {
+		t.Fatal(err)
+	}
+	record := event.Records[0]
+	if record.MessageID != "m1" || record.Body != "foo" || record.EventSource != "aws:sqs" || record.EventSourceARN != p.queueARN {
+		t.Errorf("Got %s event", data)
+	}
+	if record.Attributes["ApproximateReceiveCount"] != "1" {
+		t.Errorf("Got %v attributes", record.Attributes)
+	}
+	if v := record.MessageAttributes["kind"].StringValue; v == nil || *v != "order" {
+		t.Errorf("Got %v string attribute", record.MessageAttributes["kind"])
+	}
+	if v := record.MessageAttributes["blob"].BinaryValue; v == nil || *v != "aGk=" {
+		t.Errorf("Got %v binary attribute", record.MessageAttributes["blob"])
+	}
+}
+
+func TestPoll(t *testing.T) {
+	tests := []struct {
+		name            string
+		response        string
+		statusCode      int
+		expectedDeleted []string
+		wantErr         bool
+	}{
+		{
+			name:            "Success",
+			response:        `null`,
+			statusCode:      http.StatusOK,
+			expectedDeleted: []string{"r1", "r2", "r3"},
+		},
+		{
+			name:       "Function error",
+			response:   `{"errorMessage":"boom"}`,
+			statusCode: http.StatusInternalServerError,
+			wantErr:    true,
+		},
+		{
+			name:            "Batch item failures",
+			response:        `{"batchItemFailures":[{"itemIdentifier":"m2"}]}`,
+			statusCode:      http.StatusOK,
+			expectedDeleted: []string{"r1", "r3"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &fakeClient{messages: messages()}
+			p := &Poller{
+				BatchSize: 10,
+				client:    c,
+				invoke: func(ctx context.Context, event []byte) ([]byte, int) {
+					return []byte(tt.response), tt.statusCode
+				},
+				logger: zap.NewNop().Sugar(),
+			}
+			if err := p.poll(context.Background()); (err != nil) != tt.wantErr {
+				t.Errorf("poll() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			sort.Strings(c.deleted)
+			if !reflect.DeepEqual(c.deleted, tt.expectedDeleted) {
+				t.Errorf("Got %v deleted messages, want %v", c.deleted, tt.expectedDeleted)
+			}
+		})
+	}
+}
+
+func TestPollVisibilityTimeout(t *testing.T) {
+	tests := []struct {
+		name            string
+		wait            time.Duration
+		duration        time.Duration
+		expectedDeleted []string
+		wantErr         bool
+	}{
+		{
+			name:            "Long poll wait",
+			wait:            100 * time.Millisecond,
+			expectedDeleted: []string{"r1", "r2", "r3"},
+		},
+		{
+			name:     "Invocation outlived the timeout",
+			duration: 100 * time.Millisecond,
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &fakeClient{messages: messages(), wait: tt.wait}
+			p := &Poller{
+				BatchSize:         10,
+				VisibilityTimeout: 50 * time.Millisecond,
+				client:            c,
+				invoke: func(ctx context.Context, event []byte) ([]byte, int) {
+					time.Sleep(tt.duration)
+					return []byte(`null`), http.StatusOK
+				},
+				logger: zap.NewNop().Sugar(),
+			}
+			if err := p.poll(context.Background()); (err != nil) != tt.wantErr {
+				t.Errorf("poll() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			sort.Strings(c.deleted)
+			if !reflect.DeepEqual(c.deleted, tt.expectedDeleted) {
+				t.Errorf("Got %v deleted messages, want %v", c.deleted, tt.expectedDeleted)
+			}
+			if !reflect.DeepEqual(c.input.MessageAttributeNames, []string{"All"}) {
+				t.Errorf("Got %v message attribute names, want [All]", c.input.MessageAttributeNames)
+			}
+		})
+	}
+}
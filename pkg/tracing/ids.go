@@ -0,0 +1,72 @@
+/*
+Copyright 2023 Triggermesh Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"time"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// spanIDs are the preset ids of the started span.
+type spanIDs struct {
+	traceID trace.TraceID
+	spanID  trace.SpanID
+}
+
+type spanIDsKey struct{}
+
+// idGenerator generates the X-Ray compatible trace ids, the epoch time of
+// the trace start followed by 96 random bits, and the random span ids,
+// unless the ids are preset in the context, e.g. the ones of the received
+// X-Ray segment.
+type idGenerator struct{}
+
+var _ sdktrace.IDGenerator = idGenerator{}
+
+// withSpanIDs returns the context that presets the ids of the started span.
+// The trace id is used only by the spans without the parent.
+func withSpanIDs(ctx context.Context, traceID trace.TraceID, spanID trace.SpanID) context.Context {
+	return context.WithValue(ctx, spanIDsKey{}, spanIDs{traceID: traceID, spanID: spanID})
+}
+
+// NewIDs returns the ids of the root span.
+func (idGenerator) NewIDs(ctx context.Context) (trace.TraceID, trace.SpanID) {
+	if ids, ok := ctx.Value(spanIDsKey{}).(spanIDs); ok {
+		return ids.traceID, ids.spanID
+	}
+	var traceID trace.TraceID
+	var spanID trace.SpanID
+	binary.BigEndian.PutUint32(traceID[:xrayEpochLength/2], uint32(time.Now().Unix()))
+	rand.Read(traceID[xrayEpochLength/2:])
+	rand.Read(spanID[:])
+	return traceID, spanID
+}
+
+// NewSpanID returns the id of the child span.
+func (idGenerator) NewSpanID(ctx context.Context, _ trace.TraceID) trace.SpanID {
+	if ids, ok := ctx.Value(spanIDsKey{}).(spanIDs); ok {
+		return ids.spanID
+	}
+	var spanID trace.SpanID
+	rand.Read(spanID[:])
+	return spanID
+}
@@ -0,0 +1,217 @@
+/*
+Copyright 2023 Triggermesh Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// maxSegmentSize is the maximum size of the X-Ray daemon UDP datagram.
+const maxSegmentSize = 64 * 1024
+
+// segmentsInstrumentationName is the scope of the spans converted from the segments.
+const segmentsInstrumentationName = "aws-xray"
+
+// segment is the X-Ray segment or subsegment document.
+type segment struct {
+	Name        string                 `json:"name"`
+	ID          string                 `json:"id"`
+	TraceID     string                 `json:"trace_id"`
+	ParentID    string                 `json:"parent_id"`
+	StartTime   float64                `json:"start_time"`
+	EndTime     float64                `json:"end_time"`
+	InProgress  bool                   `json:"in_progress"`
+	Namespace   string                 `json:"namespace"`
+	Error       bool                   `json:"error"`
+	Fault       bool                   `json:"fault"`
+	Throttle    bool                   `json:"throttle"`
+	Cause       json.RawMessage        `json:"cause"`
+	HTTP        *segmentHTTP           `json:"http"`
+	Annotations map[string]interface{} `json:"annotations"`
+	Subsegments []segment              `json:"subsegments"`
+}
+
+type segmentHTTP struct {
+	Request struct {
+		Method string `json:"method"`
+		URL    string `json:"url"`
+	} `json:"request"`
+	Response struct {
+		Status int `json:"status"`
+	} `json:"response"`
+}
+
+// XRayListener receives the segments that the functions instrumented with
+// the X-Ray SDK send to the daemon and exports them as OpenTelemetry spans.
+type XRayListener struct {
+	conn   net.PacketConn
+	tracer trace.Tracer
+	logger *zap.SugaredLogger
+}
+
+// NewXRayListener starts listening for the segments on the UDP address.
+// Segments are recorded as the spans of the tracer provider set up in Setup
+// and share its span processor and exporter.
+func NewXRayListener(address string, logger *zap.SugaredLogger) (*XRayListener, error) {
+	if tracerProvider == nil {
+		return nil, errors.New("X-Ray segments listener requires the traces exporter")
+	}
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("cannot listen for X-Ray segments: %w", err)
+	}
+	return &XRayListener{
+		conn:   conn,
+		tracer: tracerProvider.Tracer(segmentsInstrumentationName),
+		logger: logger,
+	}, nil
+}
+
+// Run blocks and exports the received segments until the context is done.
+func (l *XRayListener) Run(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		l.conn.Close()
+	}()
+
+	buf := make([]byte, maxSegmentSize)
+	for {
+		n, _, err := l.conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			l.logger.Errorf("Cannot read X-Ray segment: %v", err)
+			continue
+		}
+		if err := l.record(buf[:n]); err != nil {
+			l.logger.Errorf("Cannot parse X-Ray segment: %v", err)
+		}
+	}
+}
+
+// record converts the daemon datagram, the JSON header line followed
+// by the segment document, into the spans of the completed segments.
+func (l *XRayListener) record(datagram []byte) error {
+	if i := bytes.IndexByte(datagram, '\n'); i >= 0 {
+		datagram = datagram[i+1:]
+	}
+	var s segment
+	if err := json.Unmarshal(datagram, &s); err != nil {
+		return err
+	}
+	traceID, ok := ParseXRayTraceID(s.TraceID)
+	if !ok {
+		return fmt.Errorf("invalid trace id %q", s.TraceID)
+	}
+	l.convert(s, traceID, s.ParentID)
+	return nil
+}
+
+// convert records the span of the segment and its nested subsegments with
+// the segment ids and timestamps.
+func (l *XRayListener) convert(s segment, traceID trace.TraceID, parentID string) {
+	spanID, err := trace.SpanIDFromHex(s.ID)
+	if err != nil || s.InProgress || s.EndTime == 0 {
+		return
+	}
+	ctx := withSpanIDs(context.Background(), traceID, spanID)
+	if parent, err := trace.SpanIDFromHex(parentID); err == nil {
+		ctx = trace.ContextWithRemoteSpanContext(ctx, trace.NewSpanContext(trace.SpanContextConfig{
+			TraceID:    traceID,
+			SpanID:     parent,
+			TraceFlags: trace.FlagsSampled,
+			Remote:     true,
+		}))
+	}
+	kind := trace.SpanKindInternal
+	if s.Namespace == "aws" || s.Namespace == "remote" {
+		kind = trace.SpanKindClient
+	}
+	_, span := l.tracer.Start(ctx, s.Name,
+		trace.WithSpanKind(kind),
+		trace.WithTimestamp(epochTime(s.StartTime)),
+		trace.WithAttributes(s.attributes()...),
+	)
+	if s.Error || s.Fault || s.Throttle {
+		span.SetStatus(codes.Error, s.cause())
+	}
+	span.End(trace.WithTimestamp(epochTime(s.EndTime)))
+
+	for _, sub := range s.Subsegments {
+		l.convert(sub, traceID, s.ID)
+	}
+}
+
+func (s segment) attributes() []attribute.KeyValue {
+	var attributes []attribute.KeyValue
+	if s.Namespace != "" {
+		attributes = append(attributes, attribute.String("aws.xray.namespace", s.Namespace))
+	}
+	if s.HTTP != nil {
+		if s.HTTP.Request.Method != "" {
+			attributes = append(attributes, attribute.String("http.request.method", s.HTTP.Request.Method))
+		}
+		if s.HTTP.Request.URL != "" {
+			attributes = append(attributes, attribute.String("url.full", s.HTTP.Request.URL))
+		}
+		if s.HTTP.Response.Status != 0 {
+			attributes = append(attributes, attribute.Int("http.response.status_code", s.HTTP.Response.Status))
+		}
+	}
+	for k, v := range s.Annotations {
+		key := "aws.xray.annotations." + k
+		switch v := v.(type) {
+		case string:
+			attributes = append(attributes, attribute.String(key, v))
+		case float64:
+			attributes = append(attributes, attribute.Float64(key, v))
+		case bool:
+			attributes = append(attributes, attribute.Bool(key, v))
+		}
+	}
+	return attributes
+}
+
+// cause returns the message of the first exception of the failed segment.
+func (s segment) cause() string {
+	var cause struct {
+		Exceptions []struct {
+			Message string `json:"message"`
+		} `json:"exceptions"`
+	}
+	if json.Unmarshal(s.Cause, &cause) != nil || len(cause.Exceptions) == 0 {
+		return ""
+	}
+	return cause.Exceptions[0].Message
+}
+
+// epochTime converts the X-Ray epoch seconds into the time.
+func epochTime(seconds float64) time.Time {
+	return time.Unix(0, int64(seconds*float64(time.Second)))
+}
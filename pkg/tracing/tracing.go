@@ -0,0 +1,162 @@
+/*
+Copyright 2023 Triggermesh Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/kelseyhightower/envconfig"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/triggermesh/aws-custom-runtime/pkg/converter/cloudevents"
+)
+
+const instrumentationName = "github.com/triggermesh/aws-custom-runtime"
+
+// tracerProvider is the SDK provider set up with the traces exporter,
+// nil if the spans are not exported.
+var tracerProvider *sdktrace.TracerProvider
+
+// Environment variables related to the traces exporter. Exporter settings,
+// e.g. the endpoint, headers and sampler, are read by the OpenTelemetry SDK
+// from the standard OTEL_* variables.
+type env struct {
+	// Name of the component that the current function belongs to.
+	Name string `envconfig:"name" default:"function"`
+	// Exporter is the traces exporter: otlp or none.
+	Exporter string `envconfig:"otel_traces_exporter" default:"none"`
+	// OTLPProtocol is the OTLP traces transport: grpc or http/protobuf.
+	OTLPProtocol string `envconfig:"otel_exporter_otlp_traces_protocol"`
+	// Protocol is the OTLP transport of all signals.
+	Protocol string `envconfig:"otel_exporter_otlp_protocol" default:"http/protobuf"`
+}
+
+// Setup registers the W3C trace context and X-Ray propagators and the global tracer
+// provider with the exporter selected in the environment. Spans are not
+// exported by default, but the inbound trace context is still propagated.
+func Setup() error {
+	var env env
+	if err := envconfig.Process("", &env); err != nil {
+		return fmt.Errorf("cannot process tracing env variables: %w", err)
+	}
+
+	// W3C trace context takes precedence over the X-Ray header
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		XRay{},
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	ctx := context.Background()
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch strings.ToLower(env.Exporter) {
+	case "none", "":
+		return nil
+	case "otlp":
+		protocol := env.OTLPProtocol
+		if protocol == "" {
+			protocol = env.Protocol
+		}
+		switch protocol {
+		case "grpc":
+			exporter, err = otlptracegrpc.New(ctx)
+		case "http/protobuf":
+			exporter, err = otlptracehttp.New(ctx)
+		default:
+			return fmt.Errorf("unsupported OTLP protocol %q", protocol)
+		}
+	default:
+		return fmt.Errorf("unknown traces exporter %q", env.Exporter)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create the OTLP traces exporter: %w", err)
+	}
+
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName(env.Name)),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return fmt.Errorf("cannot create resource: %w", err)
+	}
+
+	tracerProvider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithIDGenerator(idGenerator{}),
+	)
+	otel.SetTracerProvider(tracerProvider)
+	return nil
+}
+
+// Shutdown exports the buffered spans and stops the tracer provider.
+func Shutdown(ctx context.Context) error {
+	if tracerProvider == nil {
+		return nil
+	}
+	return tracerProvider.Shutdown(ctx)
+}
+
+// Tracer returns the runtime tracer of the global provider.
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// Extract returns the context with the remote span of the trace
+// context headers, e.g. the W3C "traceparent" and "tracestate".
+func Extract(ctx context.Context, header http.Header) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(header))
+}
+
+// Inject sets the trace context headers of the span in the context.
+func Inject(ctx context.Context, header http.Header) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(header))
+}
+
+// Carrier returns the trace context headers of the span in the context.
+func Carrier(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	return carrier
+}
+
+// EventSpanContext reads the CloudEvents distributed tracing extension
+// from the request context set by the CloudEvents converter.
+func EventSpanContext(runtimeContext map[string]string) trace.SpanContext {
+	var attributes map[string]string
+	if err := json.Unmarshal([]byte(runtimeContext[cloudevents.CeContextKey]), &attributes); err != nil {
+		return trace.SpanContext{}
+	}
+	carrier := propagation.MapCarrier{
+		"traceparent": attributes["traceparent"],
+		"tracestate":  attributes["tracestate"],
+	}
+	return trace.SpanContextFromContext(propagation.TraceContext{}.Extract(context.Background(), carrier))
+}
@@ -0,0 +1,67 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/triggermesh/aws-custom-runtime/pkg/converter/cloudevents"
+)
+
+const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestPropagation(t *testing.T) {
+	if err := Setup(); err != nil {
+		t.Fatal(err)
+	}
+
+	header := http.Header{}
+	header.Set("traceparent", traceparent)
+	ctx := Extract(context.Background(), header)
+	sc := trace.SpanContextFromContext(ctx)
+	if sc.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" || !sc.IsRemote() {
+		t.Errorf("Got %v span context, want remote span of the header trace", sc)
+	}
+
+	out := http.Header{}
+	Inject(ctx, out)
+	if out.Get("traceparent") != traceparent {
+		t.Errorf("Got %q traceparent, want %q", out.Get("traceparent"), traceparent)
+	}
+	if carrier := Carrier(ctx); carrier["traceparent"] != traceparent {
+		t.Errorf("Got %v carrier", carrier)
+	}
+}
+
+func TestEventSpanContext(t *testing.T) {
+	tests := []struct {
+		name     string
+		context  map[string]string
+		expected string
+	}{
+		{
+			name:     "Distributed tracing extension",
+			context:  map[string]string{cloudevents.CeContextKey: `{"id":"1","traceparent":"` + traceparent + `"}`},
+			expected: "4bf92f3577b34da6a3ce929d0e0e4736",
+		},
+		{
+			name:     "No extension",
+			context:  map[string]string{cloudevents.CeContextKey: `{"id":"1"}`},
+			expected: "00000000000000000000000000000000",
+		},
+		{
+			name:     "No event context",
+			expected: "00000000000000000000000000000000",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if traceID := EventSpanContext(tt.context).TraceID().String(); traceID != tt.expected {
+				t.Errorf("Got %q trace id, want %q", traceID, tt.expected)
+			}
+		})
+	}
+}
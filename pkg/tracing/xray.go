@@ -0,0 +1,131 @@
+/*
+Copyright 2023 Triggermesh Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracing
+
+import (
+	"context"
+	"strings"
+
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// XRayHeader is the AWS X-Ray trace header.
+const XRayHeader = "X-Amzn-Trace-Id"
+
+const (
+	xrayVersion      = "1"
+	xrayEpochLength  = 8
+	xrayRootKey      = "Root"
+	xrayParentKey    = "Parent"
+	xraySampledKey   = "Sampled"
+	traceIDHexLength = 32
+)
+
+// XRay propagates the trace context in the "Root=1-...;Parent=...;Sampled=..."
+// format of the X-Ray trace header.
+type XRay struct{}
+
+var _ propagation.TextMapPropagator = XRay{}
+
+// Inject sets the X-Ray trace header of the span in the context.
+func (XRay) Inject(ctx context.Context, carrier propagation.TextMapCarrier) {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return
+	}
+	carrier.Set(XRayHeader, XRayTraceHeader(sc))
+}
+
+// Extract returns the context with the remote span of the X-Ray trace header.
+func (XRay) Extract(ctx context.Context, carrier propagation.TextMapCarrier) context.Context {
+	sc, ok := ParseXRayTraceHeader(carrier.Get(XRayHeader))
+	if !ok {
+		return ctx
+	}
+	return trace.ContextWithRemoteSpanContext(ctx, sc)
+}
+
+// Fields returns the header set by the propagator.
+func (XRay) Fields() []string {
+	return []string{XRayHeader}
+}
+
+// XRayTraceHeader formats the span context as the X-Ray trace header.
+func XRayTraceHeader(sc trace.SpanContext) string {
+	sampled := "0"
+	if sc.IsSampled() {
+		sampled = "1"
+	}
+	return xrayRootKey + "=" + XRayTraceID(sc.TraceID()) + ";" +
+		xrayParentKey + "=" + sc.SpanID().String() + ";" +
+		xraySampledKey + "=" + sampled
+}
+
+// XRayTraceID formats the W3C trace id as the X-Ray one. X-Ray reads
+// the first 8 hex digits as the epoch time of the trace start: the ids
+// generated by the runtime follow it, the random W3C ids of the upstream
+// services do not and are rejected by X-Ray.
+func XRayTraceID(traceID trace.TraceID) string {
+	id := traceID.String()
+	return xrayVersion + "-" + id[:xrayEpochLength] + "-" + id[xrayEpochLength:]
+}
+
+// ParseXRayTraceID converts the X-Ray trace id into the W3C one.
+func ParseXRayTraceID(id string) (trace.TraceID, bool) {
+	parts := strings.Split(id, "-")
+	if len(parts) != 3 || parts[0] != xrayVersion || len(parts[1]) != xrayEpochLength {
+		return trace.TraceID{}, false
+	}
+	hex := parts[1] + parts[2]
+	if len(hex) != traceIDHexLength {
+		return trace.TraceID{}, false
+	}
+	traceID, err := trace.TraceIDFromHex(hex)
+	return traceID, err == nil
+}
+
+// ParseXRayTraceHeader reads the span context of the X-Ray trace header.
+// Headers without the parent segment id, e.g. the ones set by the load
+// balancers, are not valid span contexts.
+func ParseXRayTraceHeader(header string) (trace.SpanContext, bool) {
+	var config trace.SpanContextConfig
+	var root, parent bool
+	for _, part := range strings.Split(header, ";") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case xrayRootKey:
+			config.TraceID, root = ParseXRayTraceID(kv[1])
+		case xrayParentKey:
+			spanID, err := trace.SpanIDFromHex(kv[1])
+			config.SpanID, parent = spanID, err == nil
+		case xraySampledKey:
+			if kv[1] == "1" {
+				config.TraceFlags = trace.FlagsSampled
+			}
+		}
+	}
+	if !root || !parent {
+		return trace.SpanContext{}, false
+	}
+	config.Remote = true
+	sc := trace.NewSpanContext(config)
+	return sc, sc.IsValid()
+}
@@ -0,0 +1,147 @@
+package tracing
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+const xrayHeader = "Root=1-4bf92f35-77b34da6a3ce929d0e0e4736;Parent=00f067aa0ba902b7;Sampled=1"
+
+func TestXRayTraceHeader(t *testing.T) {
+	tests := []struct {
+		header string
+		valid  bool
+	}{
+		{header: xrayHeader, valid: true},
+		{header: "Root=1-4bf92f35-77b34da6a3ce929d0e0e4736;Parent=00f067aa0ba902b7;Sampled=1;Lineage=a87bd80c:1", valid: true},
+		{header: "Root=1-4bf92f35-77b34da6a3ce929d0e0e4736"},
+		{header: "Root=2-4bf92f35-77b34da6a3ce929d0e0e4736;Parent=00f067aa0ba902b7"},
+		{header: "Parent=00f067aa0ba902b7"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			sc, ok := ParseXRayTraceHeader(tt.header)
+			if ok != tt.valid {
+				t.Fatalf("Got %t valid header, want %t", ok, tt.valid)
+			}
+			if !ok {
+				return
+			}
+			if sc.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.SpanID().String() != "00f067aa0ba902b7" || !sc.IsSampled() {
+				t.Errorf("Got %v span context", sc)
+			}
+			if header := XRayTraceHeader(sc); header != xrayHeader {
+				t.Errorf("Got %q header, want %q", header, xrayHeader)
+			}
+		})
+	}
+}
+
+func TestXRayPropagation(t *testing.T) {
+	if err := Setup(); err != nil {
+		t.Fatal(err)
+	}
+
+	header := http.Header{}
+	header.Set(XRayHeader, xrayHeader)
+	ctx := Extract(context.Background(), header)
+	if traceID := trace.SpanContextFromContext(ctx).TraceID().String(); traceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("Got %q trace id of the X-Ray header", traceID)
+	}
+
+	// W3C trace context takes precedence
+	header.Set("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	ctx = Extract(context.Background(), header)
+	if traceID := trace.SpanContextFromContext(ctx).TraceID().String(); traceID != "0af7651916cd43dd8448eb211c80319c" {
+		t.Errorf("Got %q trace id, want the traceparent one", traceID)
+	}
+
+	carrier := Carrier(ctx)
+	if carrier[XRayHeader] != "Root=1-0af76519-16cd43dd8448eb211c80319c;Parent=b7ad6b7169203331;Sampled=1" {
+		t.Errorf("Got %q X-Ray header", carrier[XRayHeader])
+	}
+}
+
+func TestXRayListener(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithSyncer(exporter),
+		sdktrace.WithIDGenerator(idGenerator{}),
+	)
+	l := &XRayListener{
+		conn:   conn,
+		tracer: provider.Tracer(segmentsInstrumentationName),
+		logger: zap.NewNop().Sugar(),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go l.Run(ctx)
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	datagram := `{"format": "json", "version": 1}
+{"name":"handler","id":"70de5b6f19ff9a0a","trace_id":"1-4bf92f35-77b34da6a3ce929d0e0e4736","parent_id":"00f067aa0ba902b7",` +
+		`"type":"subsegment","start_time":1677666600.5,"end_time":1677666601,"fault":true,` +
+		`"cause":{"exceptions":[{"message":"boom"}]},"annotations":{"order":"o-1"},` +
+		`"subsegments":[{"name":"DynamoDB","id":"1c5a7b2e8d3f4a6b","namespace":"aws","start_time":1677666600.6,"end_time":1677666600.7},` +
+		`{"name":"pending","id":"2c5a7b2e8d3f4a6b","start_time":1677666600.8,"in_progress":true}]}`
+	if _, err := client.Write([]byte(datagram)); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(exporter.GetSpans()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("Got %d spans, want 2", len(spans))
+	}
+
+	handler, dynamo := spans[0], spans[1]
+	if handler.Name != "handler" || handler.Parent.SpanID().String() != "00f067aa0ba902b7" ||
+		handler.SpanContext.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("Got %+v segment span", handler)
+	}
+	if handler.SpanContext.SpanID().String() != "70de5b6f19ff9a0a" || handler.InstrumentationLibrary.Name != "aws-xray" {
+		t.Errorf("Got %s span id of %q scope, want segment id", handler.SpanContext.SpanID(), handler.InstrumentationLibrary.Name)
+	}
+	if handler.Status.Code != codes.Error || handler.Status.Description != "boom" {
+		t.Errorf("Got %+v segment status", handler.Status)
+	}
+	if d := handler.EndTime.Sub(handler.StartTime); d != 500*time.Millisecond {
+		t.Errorf("Got %s segment duration, want 500ms", d)
+	}
+	if dynamo.Parent.SpanID() != handler.SpanContext.SpanID() || dynamo.SpanKind != trace.SpanKindClient {
+		t.Errorf("Got %+v subsegment span", dynamo)
+	}
+}
+
+func TestXRayTraceIDEpoch(t *testing.T) {
+	traceID, _ := idGenerator{}.NewIDs(context.Background())
+	epoch, err := strconv.ParseInt(traceID.String()[:xrayEpochLength], 16, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(time.Unix(epoch, 0)); d < 0 || d > time.Minute {
+		t.Errorf("Got %s trace id with %s old epoch", traceID, d)
+	}
+}